@@ -0,0 +1,498 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"github.com/mpdroog/hfast/logger"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often a site archive is checked for replacement
+const archiveCheck = time.Second
+
+// Deflated zip members are decompressed in memory (and kept in the
+// hot cache), bigger ones once into a temp file up to ioMaxBuffer
+const archiveMaxDeflated = 1024 * 1024
+
+// archiveEntry is a file or dir in the archive, files are read
+// directly from the archive (seekable) unless deflated
+type archiveEntry struct {
+	info     fs.FileInfo
+	off      int64
+	size     int64
+	zf       *zip.File // deflated zip entry
+	children []*archiveEntry
+
+	mu  sync.Mutex
+	tmp *os.File // inflated big deflated member (unlinked)
+}
+
+// archiveFS is a read-only fs.FS of a .zip or .tar, indexed on open
+type archiveFS struct {
+	f       *os.File
+	stat    os.FileInfo
+	id      string
+	entries map[string]*archiveEntry // "." is the root
+	hot     *hotRoot                 // hot cache key of decompressed members
+
+	// A replaced (retired) archive is closed when its last file is
+	mu      sync.Mutex
+	refs    int
+	retired bool
+	closed  bool
+}
+
+// acquire takes a reference on a, false once a is closed
+func (a *archiveFS) acquire() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return false
+	}
+	a.refs++
+	return true
+}
+
+func (a *archiveFS) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.refs--
+	a.closeIdle()
+}
+
+// retire closes a as soon as no file of it is open
+func (a *archiveFS) retire() {
+	hot.purge(a.hot)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.retired = true
+	a.closeIdle()
+}
+
+func (a *archiveFS) closeIdle() {
+	if a.retired && a.refs == 0 && !a.closed {
+		a.closed = true
+		if e := a.f.Close(); e != nil {
+			logger.Printf("archive(%s) e=%s", a.id, e.Error())
+		}
+		for _, entry := range a.entries {
+			entry.mu.Lock()
+			if entry.tmp != nil {
+				entry.tmp.Close()
+				entry.tmp = nil
+			}
+			entry.mu.Unlock()
+		}
+	}
+}
+
+// openArchive indexes a .zip or (uncompressed) .tar
+func openArchive(fname string) (*archiveFS, error) {
+	f, e := os.Open(fname)
+	if e != nil {
+		return nil, e
+	}
+	stat, e := f.Stat()
+	if e != nil {
+		f.Close()
+		return nil, e
+	}
+
+	a := &archiveFS{
+		f:       f,
+		stat:    stat,
+		id:      fname + "@" + strconv.FormatInt(stat.ModTime().UnixNano(), 16),
+		entries: make(map[string]*archiveEntry),
+	}
+	a.hot = &hotRoot{dir: Dir(a.id)}
+	a.entries["."] = &archiveEntry{info: archiveDirInfo{name: ".", modtime: stat.ModTime()}}
+
+	switch {
+	case strings.HasSuffix(fname, ".zip"):
+		e = a.indexZip()
+	case strings.HasSuffix(fname, ".tar"):
+		e = a.indexTar()
+	default:
+		e = fmt.Errorf("unsupported archive")
+	}
+	if e != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", fname, e.Error())
+	}
+	return a, nil
+}
+
+func (a *archiveFS) indexZip() error {
+	r, e := zip.NewReader(a.f, a.stat.Size())
+	if e != nil {
+		return e
+	}
+	for _, zf := range r.File {
+		name, ok := archiveName(zf.Name)
+		if !ok {
+			continue
+		}
+		info := zf.FileInfo()
+		if info.IsDir() {
+			a.dir(name)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			// No symlinks
+			continue
+		}
+
+		entry := &archiveEntry{info: info, size: int64(zf.UncompressedSize64)}
+		if zf.Method == zip.Store {
+			if entry.off, e = zf.DataOffset(); e != nil {
+				return e
+			}
+		} else if entry.size > ioMaxBuffer {
+			logger.Printf("archive(%s) skipping %s, deflated and above %d bytes (store it with zip -0)", a.id, zf.Name, ioMaxBuffer)
+			continue
+		} else {
+			entry.zf = zf
+		}
+		a.add(name, entry)
+	}
+	return nil
+}
+
+func (a *archiveFS) indexTar() error {
+	// os.File seeks over the member data instead of reading it
+	tr := tar.NewReader(a.f)
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		name, ok := archiveName(hdr.Name)
+		if !ok {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			a.dir(name)
+		case tar.TypeReg:
+			// Data directly follows the header
+			off, e := a.f.Seek(0, io.SeekCurrent)
+			if e != nil {
+				return e
+			}
+			a.add(name, &archiveEntry{info: hdr.FileInfo(), off: off, size: hdr.Size})
+		}
+	}
+}
+
+// archiveName cleans a member name, false for names outside the root
+func archiveName(name string) (string, bool) {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "./"), "/")
+	if name == "" || !fs.ValidPath(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// dir returns the dir entry of name, creating it (and parents)
+func (a *archiveFS) dir(name string) *archiveEntry {
+	if entry, ok := a.entries[name]; ok {
+		return entry
+	}
+	entry := &archiveEntry{info: archiveDirInfo{name: path.Base(name), modtime: a.stat.ModTime()}}
+	a.add(name, entry)
+	return entry
+}
+
+func (a *archiveFS) add(name string, entry *archiveEntry) {
+	if _, ok := a.entries[name]; ok {
+		// Duplicate member, first one wins
+		return
+	}
+	parent := a.dir(path.Dir(name))
+	if !parent.info.IsDir() {
+		return
+	}
+	parent.children = append(parent.children, entry)
+	a.entries[name] = entry
+}
+
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, ok := a.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if entry.info.IsDir() {
+		return &archiveDir{entry: entry}, nil
+	}
+	if entry.zf != nil && entry.size > archiveMaxDeflated {
+		f, e := a.spill(entry)
+		if e != nil {
+			return nil, e
+		}
+		return &archiveFile{SectionReader: io.NewSectionReader(f, 0, entry.size), entry: entry}, nil
+	}
+	if entry.zf != nil {
+		content, e := a.inflate(name, entry)
+		if e != nil {
+			return nil, e
+		}
+		return &archiveMem{Reader: bytes.NewReader(content), entry: entry}, nil
+	}
+	return &archiveFile{SectionReader: io.NewSectionReader(a.f, entry.off, entry.size), entry: entry}, nil
+}
+
+// archiveFile is a stored member, seekable
+type archiveFile struct {
+	*io.SectionReader
+	entry *archiveEntry
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.entry.info, nil }
+func (f *archiveFile) Close() error               { return nil }
+
+// inflate returns the decompressed member, from the hot cache when
+// another request already did
+func (a *archiveFS) inflate(name string, entry *archiveEntry) ([]byte, error) {
+	k := hotKey{root: a.hot, name: name}
+	if cached, ok := hot.get(k); ok {
+		return cached.content, nil
+	}
+	rc, e := entry.zf.Open()
+	if e != nil {
+		return nil, e
+	}
+	defer rc.Close()
+	content, e := io.ReadAll(io.LimitReader(rc, archiveMaxDeflated+1))
+	if e != nil {
+		return nil, e
+	}
+	if int64(len(content)) != entry.size {
+		return nil, fmt.Errorf("%s size mismatch", name)
+	}
+	hot.set(&hotEntry{key: k, content: content, info: entry.info, cost: int64(len(content)) + int64(len(name))}, 0)
+	return content, nil
+}
+
+// spill inflates a big deflated member once into a temp file, kept
+// until the archive is closed
+func (a *archiveFS) spill(entry *archiveEntry) (*os.File, error) {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.tmp != nil {
+		return entry.tmp, nil
+	}
+
+	rc, e := entry.zf.Open()
+	if e != nil {
+		return nil, e
+	}
+	defer rc.Close()
+	f, e := os.CreateTemp("", "hfast-archive-")
+	if e != nil {
+		return nil, e
+	}
+	// Unlinked, gone with the last Close
+	if e := os.Remove(f.Name()); e != nil {
+		f.Close()
+		return nil, e
+	}
+	n, e := io.Copy(f, io.LimitReader(rc, entry.size+1))
+	if e == nil && n != entry.size {
+		e = fmt.Errorf("%s size mismatch", entry.zf.Name)
+	}
+	if e != nil {
+		f.Close()
+		return nil, e
+	}
+	entry.tmp = f
+	return f, nil
+}
+
+// archiveMem is a decompressed member, seekable
+type archiveMem struct {
+	*bytes.Reader
+	entry *archiveEntry
+}
+
+func (f *archiveMem) Stat() (fs.FileInfo, error) { return f.entry.info, nil }
+func (f *archiveMem) Close() error               { return nil }
+
+type archiveDir struct {
+	entry *archiveEntry
+	pos   int
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) { return d.entry.info, nil }
+func (d *archiveDir) Close() error               { return nil }
+
+func (d *archiveDir) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("%s is a directory", d.entry.info.Name())
+}
+
+func (d *archiveDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	rest := d.entry.children[d.pos:]
+	if count > 0 && len(rest) > count {
+		rest = rest[:count]
+	}
+	if count > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	out := make([]fs.DirEntry, 0, len(rest))
+	for _, entry := range rest {
+		out = append(out, fs.FileInfoToDirEntry(entry.info))
+	}
+	d.pos += len(rest)
+	return out, nil
+}
+
+// archiveDirInfo is an (implied) dir in the archive
+type archiveDirInfo struct {
+	name    string
+	modtime time.Time
+}
+
+func (i archiveDirInfo) Name() string       { return i.name }
+func (i archiveDirInfo) Size() int64        { return 0 }
+func (i archiveDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (i archiveDirInfo) ModTime() time.Time { return i.modtime }
+func (i archiveDirInfo) IsDir() bool        { return true }
+func (i archiveDirInfo) Sys() interface{}   { return nil }
+
+// archiveSite is the FileSystem of a site deployed as pub.zip/pub.tar,
+// a replaced archive (mv pub.zip.new pub.zip) is picked up within
+// archiveCheck without reload
+type archiveSite struct {
+	path    string
+	mu      sync.Mutex
+	cur     atomic.Pointer[archiveFS]
+	checked atomic.Int64 // unixnano
+	gen     uint64       // last loadSites using it (archiveSitesMu)
+}
+
+var (
+	archiveSitesMu sync.Mutex
+	archiveSites   = make(map[string]*archiveSite)
+)
+
+// ArchiveFS returns the (shared across reloads) FileSystem of archive fname
+func ArchiveFS(fname string) (FileSystem, error) {
+	archiveSitesMu.Lock()
+	defer archiveSitesMu.Unlock()
+	if s, ok := archiveSites[fname]; ok {
+		s.refresh()
+		s.gen = loadGen.Load()
+		return s, nil
+	}
+
+	a, e := openArchive(fname)
+	if e != nil {
+		return nil, e
+	}
+	s := &archiveSite{path: fname, gen: loadGen.Load()}
+	s.cur.Store(a)
+	s.checked.Store(time.Now().UnixNano())
+	archiveSites[fname] = s
+	return s, nil
+}
+
+// current returns the active archive, checking for a replacement
+func (s *archiveSite) current() *archiveFS {
+	if time.Now().UnixNano()-s.checked.Load() > int64(archiveCheck) {
+		s.refresh()
+	}
+	return s.cur.Load()
+}
+
+func (s *archiveSite) refresh() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checked.Store(time.Now().UnixNano())
+
+	old := s.cur.Load()
+	stat, e := os.Stat(s.path)
+	if e != nil || (os.SameFile(stat, old.stat) && stat.ModTime().Equal(old.stat.ModTime()) && stat.Size() == old.stat.Size()) {
+		// Gone (keep serving) or unchanged
+		return
+	}
+	a, e := openArchive(s.path)
+	if e != nil {
+		logger.Printf("archive(%s) keeping previous e=%s", s.path, e.Error())
+		return
+	}
+	s.cur.Store(a)
+	logger.Printf("archive(%s) replaced", s.path)
+	old.retire()
+}
+
+// pruneArchives closes the archives not used by generation gen
+func pruneArchives(gen uint64) {
+	archiveSitesMu.Lock()
+	defer archiveSitesMu.Unlock()
+	for fname, s := range archiveSites {
+		if s.gen != gen {
+			delete(archiveSites, fname)
+			s.cur.Load().retire()
+		}
+	}
+}
+
+func (s *archiveSite) String() string {
+	return s.current().id
+}
+
+func (s *archiveSite) Open(name string) (File, error) {
+	a := s.current()
+	for !a.acquire() {
+		// Retired and closed in between, cur is already the new one
+		next := s.current()
+		if next == a {
+			// Site dropped on reload
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrClosed}
+		}
+		a = next
+	}
+	f, e := IOFS{FS: a, Name: a.id}.Open(name)
+	if e != nil {
+		a.release()
+		return nil, e
+	}
+	return &archiveRef{File: f, a: a}, nil
+}
+
+// archiveRef keeps the archive open until the file is closed
+type archiveRef struct {
+	File
+	a      *archiveFS
+	closed bool
+}
+
+func (f *archiveRef) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	e := f.File.Close()
+	f.a.release()
+	return e
+}
+
+func (s *archiveSite) Exists(name string) (bool, error) {
+	a := s.current()
+	return IOFS{FS: a, Name: a.id}.Exists(name)
+}
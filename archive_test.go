@@ -0,0 +1,239 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"github.com/mpdroog/hfast/config"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeZip(t *testing.T, fname string, files map[string]string) {
+	f, e := os.Create(fname)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		method := zip.Store
+		if strings.HasSuffix(name, ".txt") {
+			method = zip.Deflate
+		}
+		w, e := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if e != nil {
+			t.Fatal(e)
+		}
+		if _, e := io.WriteString(w, content); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := zw.Close(); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func archiveGet(t *testing.T, h http.Handler, url string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestArchiveZip(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "pub.zip")
+	writeZip(t, fname, map[string]string{
+		"index.html":     "<h1>home</h1>",
+		"js/app.js":      "console.log(1);",
+		"js/app.js.gz":   "GZIP",
+		"docs/large.txt": strings.Repeat("deflated ", 100),
+		"../escape.txt":  "nope",
+	})
+
+	fs, e := ArchiveFS(fname)
+	if e != nil {
+		t.Fatal(e)
+	}
+	h := FileServer(fs)
+
+	// Unknown hosts get a 404 status on /, the body is still served
+	if w := archiveGet(t, h, "/", nil); w.Body.String() != "<h1>home</h1>" {
+		t.Errorf("unexpected index %s", w.Body.String())
+	}
+	w := archiveGet(t, h, "/js/app.js", map[string]string{"Range": "bytes=8-10"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "log" {
+		t.Errorf("range expect 206 log, got=%d %s", w.Code, w.Body.String())
+	}
+	w = archiveGet(t, h, "/js/app.js", map[string]string{"Accept-Encoding": "gzip"})
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Body.String() != "GZIP" {
+		t.Errorf("precompressed expect gzip variant, got=%s %s", w.Header().Get("Content-Encoding"), w.Body.String())
+	}
+	if w := archiveGet(t, h, "/docs/large.txt", nil); w.Body.String() != strings.Repeat("deflated ", 100) {
+		t.Errorf("deflated entry mismatch")
+	}
+	if w := archiveGet(t, h, "/docs/", nil); w.Code != http.StatusForbidden {
+		t.Errorf("dir without index expect 403, got=%d", w.Code)
+	}
+	if ok, _ := fs.Exists("/escape.txt"); ok {
+		t.Errorf("member outside root indexed")
+	}
+
+	// Atomic deploy: replace the archive, a download in progress
+	// keeps reading the old one
+	old := fs.(*archiveSite).cur.Load()
+	inflight, e := fs.Open("/js/app.js")
+	if e != nil {
+		t.Fatal(e)
+	}
+	writeZip(t, fname+".new", map[string]string{"index.html": "<h1>v2</h1>"})
+	if e := os.Rename(fname+".new", fname); e != nil {
+		t.Fatal(e)
+	}
+	fs.(*archiveSite).checked.Store(0)
+	if w := archiveGet(t, h, "/", nil); w.Body.String() != "<h1>v2</h1>" {
+		t.Errorf("expected replaced archive, got=%s", w.Body.String())
+	}
+	if b, e := io.ReadAll(inflight); e != nil || string(b) != "console.log(1);" {
+		t.Errorf("in-flight read of old archive failed %s %v", b, e)
+	}
+	if old.closed {
+		t.Errorf("old archive closed while in use")
+	}
+	inflight.Close()
+	if !old.closed {
+		t.Errorf("old archive not closed after last file")
+	}
+	if ok, _ := fs.Exists("/js/app.js"); ok {
+		t.Errorf("old archive still served")
+	}
+}
+
+func TestPruneArchives(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "pub.zip")
+	writeZip(t, fname, map[string]string{"index.html": "ok"})
+	site, e := ArchiveFS(fname)
+	if e != nil {
+		t.Fatal(e)
+	}
+	a := site.(*archiveSite).cur.Load()
+	pruneArchives(loadGen.Add(1))
+
+	if !a.closed {
+		t.Errorf("expect unused archive closed")
+	}
+	if _, e := site.Open("/index.html"); !errors.Is(e, fs.ErrClosed) {
+		t.Errorf("expect dropped site closed, got=%v", e)
+	}
+	if _, ok := archiveSites[fname]; ok {
+		t.Errorf("expect unused archive dropped")
+	}
+}
+
+func TestArchiveDeflated(t *testing.T) {
+	old := config.Server.HotCache
+	config.Server.HotCache = 1
+	defer func() { config.Server.HotCache = old }()
+
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "pub.zip")
+	writeZip(t, fname, map[string]string{"docs/large.txt": strings.Repeat("deflated ", 100)})
+	a, e := openArchive(fname)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer a.f.Close()
+
+	for i := 0; i < 2; i++ {
+		f, e := a.Open("docs/large.txt")
+		if e != nil {
+			t.Fatal(e)
+		}
+		if _, ok := f.(io.Seeker); !ok {
+			t.Errorf("deflated member not seekable")
+		}
+		f.Close()
+	}
+	if _, ok := hot.get(hotKey{root: a.hot, name: "docs/large.txt"}); !ok {
+		t.Errorf("deflated member not cached")
+	}
+
+	// Bigger ones are inflated once to a temp file, above ioMaxBuffer skipped
+	big := filepath.Join(dir, "big.zip")
+	large := strings.Repeat("x", archiveMaxDeflated+1)
+	writeZip(t, big, map[string]string{"large.txt": large, "huge.txt": strings.Repeat("x", ioMaxBuffer+1), "index.html": "ok"})
+	b, e := openArchive(big)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer b.f.Close()
+	if _, e := b.Open("huge.txt"); !errors.Is(e, fs.ErrNotExist) {
+		t.Errorf("expect huge deflated member skipped, got=%v", e)
+	}
+	for i := 0; i < 2; i++ {
+		f, e := b.Open("large.txt")
+		if e != nil {
+			t.Fatal(e)
+		}
+		content, e := io.ReadAll(f)
+		if e != nil || string(content) != large {
+			t.Errorf("large member mismatch len=%d e=%v", len(content), e)
+		}
+		f.Close()
+	}
+	tmp := b.entries["large.txt"].tmp
+	b.retire()
+	if tmp == nil || tmp.Close() == nil {
+		t.Errorf("expect temp file closed with the archive")
+	}
+}
+
+func TestArchiveTar(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "pub.tar")
+	f, e := os.Create(fname)
+	if e != nil {
+		t.Fatal(e)
+	}
+	tw := tar.NewWriter(f)
+	files := map[string]string{
+		"./css/site.css": "body{color:red}",
+		"./index.html":   "<h1>tar</h1>",
+	}
+	for name, content := range files {
+		if e := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); e != nil {
+			t.Fatal(e)
+		}
+		if _, e := io.WriteString(tw, content); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := tw.Close(); e != nil {
+		t.Fatal(e)
+	}
+	f.Close()
+
+	fs, e := ArchiveFS(fname)
+	if e != nil {
+		t.Fatal(e)
+	}
+	h := FileServer(fs)
+	if w := archiveGet(t, h, "/css/site.css", nil); w.Body.String() != "body{color:red}" || w.Header().Get("Content-Type") != "text/css; charset=utf-8" {
+		t.Errorf("unexpected css %s %v", w.Body.String(), w.Header())
+	}
+	if w := archiveGet(t, h, "/", nil); w.Body.String() != "<h1>tar</h1>" {
+		t.Errorf("unexpected index %s", w.Body.String())
+	}
+	if w := archiveGet(t, h, "/missing.css", nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing expect 404, got=%d", w.Code)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/mpdroog/hfast/handlers"
+	"github.com/mpdroog/hfast/logger"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long an authorization result is reused for the same client
+const authCacheTTL = 5 * time.Second
+
+// Max cached results, beyond it expired ones are dropped (or all)
+const authCacheMax = 10000
+
+// validateAuthRequest checks the prefixes and scripts
+func validateAuthRequest(rules map[string]string) []error {
+	errs := []error{}
+	prefixes := make([]string, 0, len(rules))
+	for prefix := range rules {
+		prefixes = append(prefixes, prefix)
+	}
+	for _, prefix := range longestFirst(prefixes) {
+		if !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") {
+			errs = append(errs, fmt.Errorf("overrides.AuthRequest invalid (expect /dir/), given=%s", prefix))
+		}
+		if !validScript(rules[prefix]) {
+			errs = append(errs, fmt.Errorf("overrides.AuthRequest[%s] invalid (expect script below site dir), given=%s", prefix, rules[prefix]))
+		}
+	}
+	return errs
+}
+
+// longestFirst sorts prefixes longest first, so the most specific
+// rule wins
+func longestFirst(prefixes []string) []string {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if len(prefixes[i]) != len(prefixes[j]) {
+			return len(prefixes[i]) > len(prefixes[j])
+		}
+		return prefixes[i] < prefixes[j]
+	})
+	return prefixes
+}
+
+// authResult is the outcome of a subrequest
+type authResult struct {
+	code    int
+	auth    string // WWW-Authenticate
+	expires time.Time
+}
+
+// authRequest asks a PHP script if a static file may be served,
+// nginx auth_request alike
+type authRequest struct {
+	h        http.Handler
+	prefixes []string
+	scripts  map[string]http.Handler
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]authResult
+}
+
+// AuthRequest protects the prefixes of h with the PHP handler per prefix
+func AuthRequest(h http.Handler, scripts map[string]http.Handler) http.Handler {
+	prefixes := make([]string, 0, len(scripts))
+	for prefix := range scripts {
+		prefixes = append(prefixes, prefix)
+	}
+	return &authRequest{
+		h:        h,
+		prefixes: longestFirst(prefixes),
+		scripts:  scripts,
+		cache:    make(map[[sha256.Size]byte]authResult),
+	}
+}
+
+func (a *authRequest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := ""
+	for _, p := range a.prefixes {
+		if strings.HasPrefix(r.URL.Path, p) {
+			prefix = p
+			break
+		}
+	}
+	if prefix == "" {
+		a.h.ServeHTTP(w, r)
+		return
+	}
+
+	res := a.authorize(prefix, r)
+	switch {
+	case res.code >= 200 && res.code < 300:
+		// Per-user content, not for shared caches
+		w.Header().Set("Cache-Control", "private")
+		a.h.ServeHTTP(w, r)
+	case res.code == http.StatusUnauthorized || res.code == http.StatusForbidden:
+		if res.auth != "" {
+			w.Header().Set("WWW-Authenticate", res.auth)
+		}
+		handlers.Error(w, r, res.code)
+	case res.code == http.StatusTooManyRequests:
+		handlers.Error(w, r, res.code)
+	default:
+		logger.Printf("authrequest(%s) unexpected status=%d", prefix, res.code)
+		handlers.Error(w, r, http.StatusInternalServerError)
+	}
+}
+
+// authorize returns the (cached) subrequest result for the client,
+// results are kept per path, IP, cookie and Authorization
+func (a *authRequest) authorize(prefix string, r *http.Request) authResult {
+	ip, _, e := net.SplitHostPort(r.RemoteAddr)
+	if e != nil {
+		ip = r.RemoteAddr
+	}
+	key := sha256.Sum256([]byte(prefix + "\x00" + r.URL.Path + "\x00" + ip + "\x00" + r.Header.Get("Cookie") + "\x00" + r.Header.Get("Authorization")))
+
+	now := time.Now()
+	a.mu.Lock()
+	res, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && now.Before(res.expires) {
+		return res
+	}
+
+	// Subrequest without body, PHP sees the original URI and headers
+	sub := r.Clone(r.Context())
+	sub.Method = "GET"
+	sub.Body = http.NoBody
+	sub.ContentLength = 0
+	sub.Header.Del("Content-Type")
+	sub.Header.Del("Content-Length")
+	sub.Header.Set("X-Original-Method", r.Method)
+	rec := &authRecorder{header: make(http.Header)}
+	a.scripts[prefix].ServeHTTP(rec, sub)
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+
+	res = authResult{code: rec.code, auth: rec.header.Get("WWW-Authenticate"), expires: now.Add(authCacheTTL)}
+	if rec.code >= 500 || rec.code == http.StatusTooManyRequests {
+		// Don't cache backend failures or the ratelimiter
+		return res
+	}
+	a.mu.Lock()
+	if len(a.cache) >= authCacheMax {
+		for k, v := range a.cache {
+			if now.After(v.expires) {
+				delete(a.cache, k)
+			}
+		}
+		if len(a.cache) >= authCacheMax {
+			a.cache = make(map[[sha256.Size]byte]authResult)
+		}
+	}
+	a.cache[key] = res
+	a.mu.Unlock()
+	return res
+}
+
+// authRecorder keeps the status and headers of the subrequest,
+// the body is discarded
+type authRecorder struct {
+	header http.Header
+	code   int
+}
+
+func (a *authRecorder) Header() http.Header {
+	return a.header
+}
+
+func (a *authRecorder) WriteHeader(code int) {
+	if a.code == 0 {
+		a.code = code
+	}
+}
+
+func (a *authRecorder) Write(b []byte) (int, error) {
+	if a.code == 0 {
+		a.code = http.StatusOK
+	}
+	return len(b), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAuthRequest(t *testing.T) {
+	static := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("file " + r.URL.Path))
+	})
+	calls := 0
+	php := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Method != "GET" || r.Header.Get("X-Original-Method") == "" {
+			t.Errorf("unexpected subrequest %s %v", r.Method, r.Header)
+		}
+		switch r.Header.Get("Cookie") {
+		case "session=member":
+			if r.URL.Path == "/members/secret.pdf" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte("ok"))
+		case "session=broken":
+			w.WriteHeader(http.StatusFound)
+		case "session=flood":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Header().Set("WWW-Authenticate", `Basic realm="members"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	h := AuthRequest(static, map[string]http.Handler{"/members/": php})
+
+	if w := archiveGet(t, h, "/public.txt", nil); w.Body.String() != "file /public.txt" || calls != 0 {
+		t.Errorf("unprotected expect file without subrequest, got=%s calls=%d", w.Body.String(), calls)
+	}
+
+	member := map[string]string{"Cookie": "session=member"}
+	if w := archiveGet(t, h, "/members/report.png", member); w.Body.String() != "file /members/report.png" || w.Header().Get("Cache-Control") != "private" {
+		t.Errorf("member expect private file, got=%d %s %v", w.Code, w.Body.String(), w.Header())
+	}
+	if w := archiveGet(t, h, "/members/report.png", member); w.Code != http.StatusOK || calls != 1 {
+		t.Errorf("expect cached result, got=%d calls=%d", w.Code, calls)
+	}
+	// Script decides per file
+	if w := archiveGet(t, h, "/members/secret.pdf", member); w.Code != http.StatusForbidden || calls != 2 {
+		t.Errorf("other file expect own subrequest 403, got=%d calls=%d", w.Code, calls)
+	}
+
+	w := archiveGet(t, h, "/members/report.png", nil)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Basic realm="members"` {
+		t.Errorf("anonymous expect 401, got=%d %v", w.Code, w.Header())
+	}
+	if w := archiveGet(t, h, "/members/report.pdf", map[string]string{"Cookie": "session=broken"}); w.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected status expect 500, got=%d", w.Code)
+	}
+
+	// Ratelimited subrequest is relayed, not cached
+	flood := map[string]string{"Cookie": "session=flood"}
+	before := calls
+	for i := 0; i < 2; i++ {
+		if w := archiveGet(t, h, "/members/report.pdf", flood); w.Code != http.StatusTooManyRequests {
+			t.Errorf("ratelimited expect 429, got=%d", w.Code)
+		}
+	}
+	if calls != before+2 {
+		t.Errorf("expect 429 not cached, calls=%d", calls-before)
+	}
+}
+
+func TestValidateAuthRequest(t *testing.T) {
+	if errs := validateAuthRequest(map[string]string{"/members/": "auth/index.php"}); len(errs) > 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+	bad := []map[string]string{
+		{"/members": "auth/index.php"},
+		{"/members/": "/srv/auth.php"},
+		{"/members/": "../auth.php"},
+		{"/members/": "auth/index.html"},
+	}
+	for _, rules := range bad {
+		if errs := validateAuthRequest(rules); len(errs) == 0 {
+			t.Errorf("expect error for %v", rules)
+		}
+	}
+}
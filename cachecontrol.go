@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// defaultCacheControl is the Cache-Control for paths without a CacheRules match
+func defaultCacheControl(upath string) string {
+	if strings.HasSuffix(upath, ".html") || upath == "/" {
+		// Force browser to check for HTML change
+		return "no-cache,no-store,must-revalidate"
+	}
+
+	if strings.HasSuffix(upath, ".css") ||
+		strings.HasSuffix(upath, ".js") ||
+		strings.HasSuffix(upath, ".png") ||
+		strings.HasSuffix(upath, ".gif") ||
+		strings.HasSuffix(upath, ".jpg") {
+		// Force browser to cache this one month
+		return "public,max-age=2678400"
+	}
+	return ""
+}
+
+// matchCacheRule reports if pattern from CacheRules matches upath:
+// ".ext" matches the extension, "/dir/" everything below dir and
+// anything else is a path.Match glob (on the basename when without /)
+func matchCacheRule(pattern, upath string) bool {
+	switch {
+	case strings.HasPrefix(pattern, "."):
+		return strings.HasSuffix(upath, pattern)
+	case strings.HasSuffix(pattern, "/"):
+		return strings.HasPrefix(upath, pattern)
+	case strings.Contains(pattern, "/"):
+		ok, _ := path.Match(pattern, upath)
+		return ok
+	}
+	ok, _ := path.Match(pattern, path.Base(upath))
+	return ok
+}
+
+// validateCacheRules returns the patterns path.Match rejects
+func validateCacheRules(rules map[string]string) []error {
+	errs := []error{}
+	for pattern := range rules {
+		if _, e := path.Match(pattern, ""); e != nil {
+			errs = append(errs, fmt.Errorf("overrides.CacheRules invalid pattern=%s e=%s", pattern, e.Error()))
+		}
+	}
+	return errs
+}
+
+// cacheControl returns the Cache-Control for upath, the longest matching
+// CacheRules pattern wins. Revisioned URLs (asset.vNNN.css) never change
+// so cacheable ones are marked immutable.
+func cacheControl(rules map[string]string, upath string) string {
+	best := ""
+	found := false
+	for pattern := range rules {
+		if !matchCacheRule(pattern, upath) {
+			continue
+		}
+		if !found || len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best) {
+			best = pattern
+			found = true
+		}
+	}
+
+	cc := defaultCacheControl(upath)
+	if found {
+		cc = rules[best]
+	}
+
+	if cc != "" && revisioned(upath) != upath &&
+		!strings.Contains(cc, "no-") && !strings.Contains(cc, "private") && !strings.Contains(cc, "immutable") {
+		cc += ",immutable"
+	}
+	return cc
+}
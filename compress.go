@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"github.com/mpdroog/hfast/config"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Files outside this size range are not compressed on the fly
+// (too small to win anything, too big to keep in memory)
+const (
+	compressMinSize = 512
+	compressMaxSize = 8 * 1024 * 1024
+)
+
+// dynamicCodings are the encoders available for on-the-fly compression,
+// brotli and zstd are only served from precompressed variants as there
+// is no encoder for them in the stdlib
+var dynamicCodings = []struct {
+	contentCoding
+	writer func(io.Writer) (io.WriteCloser, error)
+}{
+	{contentCoding{"gzip", ".gz"}, func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	}},
+}
+
+// compressName is a file in a root, compressKey one version of it
+type compressName struct {
+	root   string
+	name   string
+	coding string
+}
+
+type compressKey struct {
+	compressName
+	size  int64
+	mtime int64
+}
+
+type compressEntry struct {
+	key  compressKey
+	data []byte
+}
+
+// compressCall is a compression in progress, concurrent misses for
+// the same key wait for it instead of compressing again
+type compressCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// compressCache is an LRU of compressed files bounded by
+// config.Server.CompressCache, a changed source file (size/mtime)
+// replaces the stale version
+type compressCache struct {
+	mu     sync.Mutex
+	lru    *list.List // front=most recently used
+	keys   map[compressKey]*list.Element
+	latest map[compressName]compressKey
+	calls  map[compressKey]*compressCall
+	bytes  int64
+}
+
+var compressed = &compressCache{
+	lru:    list.New(),
+	keys:   make(map[compressKey]*list.Element),
+	latest: make(map[compressName]compressKey),
+	calls:  make(map[compressKey]*compressCall),
+}
+
+func (c *compressCache) get(k compressKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.keys[k]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*compressEntry).data, true
+}
+
+// load returns the cached data of k or the result of fn, one fn runs per
+// key at a time and only output smaller than size is cached
+func (c *compressCache) load(k compressKey, size int64, fn func() ([]byte, error)) ([]byte, error) {
+	if data, ok := c.get(k); ok {
+		return data, nil
+	}
+
+	c.mu.Lock()
+	if call, ok := c.calls[k]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.data, call.err
+	}
+	call := &compressCall{done: make(chan struct{})}
+	c.calls[k] = call
+	c.mu.Unlock()
+
+	call.data, call.err = fn()
+	if call.err == nil && int64(len(call.data)) < size {
+		c.set(k, call.data)
+	}
+	c.mu.Lock()
+	delete(c.calls, k)
+	c.mu.Unlock()
+	close(call.done)
+	return call.data, call.err
+}
+
+func (c *compressCache) set(k compressKey, data []byte) {
+	max := int64(config.Server.CompressCache) * 1024 * 1024
+	if int64(len(data)) > max {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.latest[k.compressName]; ok {
+		// Drop the stale version (or a concurrent duplicate)
+		if elem, ok := c.keys[old]; ok {
+			c.remove(elem)
+		}
+	}
+	for c.bytes+int64(len(data)) > max {
+		c.remove(c.lru.Back())
+	}
+
+	c.keys[k] = c.lru.PushFront(&compressEntry{key: k, data: data})
+	c.latest[k.compressName] = k
+	c.bytes += int64(len(data))
+}
+
+func (c *compressCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*compressEntry)
+	delete(c.keys, entry.key)
+	if c.latest[entry.key.compressName] == entry.key {
+		delete(c.latest, entry.key.compressName)
+	}
+	c.bytes -= int64(len(entry.data))
+}
+
+// variantETag derives the ETag of an encoded representation, it has
+// to differ from the identity one for Range and If-Range
+func variantETag(etag, coding string) string {
+	return strings.TrimSuffix(etag, "\"") + "-" + coding + "\""
+}
+
+// compress returns the encoded content of f, f is rewound to the start
+func compress(writer func(io.Writer) (io.WriteCloser, error), f io.ReadSeeker) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc, e := writer(buf)
+	if e == nil {
+		if _, e = io.Copy(enc, f); e == nil {
+			e = enc.Close()
+		}
+	}
+	if _, se := f.Seek(0, io.SeekStart); se != nil && e == nil {
+		e = se
+	}
+	return buf.Bytes(), e
+}
+
+// serveCompressed serves f compressed on the fly (from cache) when the
+// client accepts it and no precompressed variant was picked, it returns
+// false when the caller should serve f as-is
+func serveCompressed(w http.ResponseWriter, r *http.Request, fs FileSystem, name string, d os.FileInfo, f File) bool {
+	if config.Server.CompressCache <= 0 || w.Header().Get("Content-Encoding") != "" {
+		return false
+	}
+	if d.Size() < compressMinSize || d.Size() > compressMaxSize {
+		return false
+	}
+	if !precompressable(siteOf(r).PrecompressExt(), name) {
+		return false
+	}
+
+	accept := acceptEncoding(r.Header.Get("Accept-Encoding"))
+	idx := -1
+	bestQ := 0.0
+	for i, c := range dynamicCodings {
+		if q := qvalue(accept, c.name); q > bestQ {
+			idx, bestQ = i, q
+		}
+	}
+	if idx == -1 {
+		return false
+	}
+	coding := dynamicCodings[idx]
+
+	etag, e := fileETag(fs, name, d, f)
+	if e != nil {
+		return false
+	}
+
+	k := compressKey{
+		compressName: compressName{root: fsID(fs), name: name, coding: coding.name},
+		size:         d.Size(),
+		mtime:        d.ModTime().UnixNano(),
+	}
+	data, e := compressed.load(k, d.Size(), func() ([]byte, error) {
+		return compress(coding.writer, f)
+	})
+	if e != nil || int64(len(data)) >= d.Size() {
+		// Failed or incompressible, serve as-is
+		return false
+	}
+
+	w.Header().Set("Content-Encoding", coding.name)
+	if w.Header().Get("Etag") == "" {
+		w.Header().Set("Etag", variantETag(etag, coding.name))
+	}
+	sizeFunc := func() (int64, error) { return int64(len(data)), nil }
+	serveContent(w, r, d.Name(), d.ModTime(), sizeFunc, bytes.NewReader(data))
+	return true
+}
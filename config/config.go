@@ -1,8 +1,14 @@
 package config
 
 import (
+	"context"
+	"fmt"
 	"golang.org/x/text/language"
 	"net/http"
+	"net/netip"
+	"path/filepath"
+	"sync/atomic"
+	"time"
 )
 
 type Override struct {
@@ -17,22 +23,223 @@ type Override struct {
 	Ratelimit       bool              // Override (default on) ratelimiter on PHP-code
 
 	SecretKey string // Secret key used for hashing queue's (needed to have queueing enabled)
+
+	PHPFPM        Backends // FastCGI address(es) (inherits Global.PHPFPM when empty)
+	PHPFPMBalance string   // Multiple PHPFPM: roundrobin (default) or leastconn
+	RatelimitRate int      // PHP requests per minute per IP (inherits Global.RatelimitRate when 0)
+
+	CacheRules  map[string]string // Static Cache-Control by ".ext", "/dir/" or glob (longest match wins)
+	Precompress []string          // Extensions with .br/.zst/.gz variants (inherits Global.Precompress when empty)
+	ImageKey    string            // HMAC-SHA256 secret for /_resize/ (needed to have resizing enabled)
+	Fallback    []string          // Dirs searched after pub/ (i.e. shared theme)
+	Listing     []string          // Path prefixes with directory listing (i.e. /downloads/)
+	TryFiles    []string          // Static candidates ($uri, $uri.html, /index.html, @php, =404)
+	Private     string            // Dir for PHP's X-Sendfile/X-Accel-Redirect (default <site>/private)
+	AuthRequest map[string]string // Static prefix authorized by a PHP script (i.e. "/members/" = "auth/index.php")
+	Signed      []string          // Static prefixes only served with ?exp=&sig= (HMAC with SecretKey)
+	Env         map[string]string // Extra FastCGI params for PHP ($_SERVER)
+
+	Routes map[string]Route // Extra mounts by path prefix (i.e. "/api/")
 }
 
-const MAX_WORKERS = 50000        // max 50k go-routines per listener
-const PHP_FPM = "127.0.0.1:8000" // default FPM path
+// Route mounts a path prefix onto a PHP script, static dir or
+// proxy upstream (exactly one of them)
+type Route struct {
+	PHP           string // Script below the site dir (i.e. api/index.php)
+	Dir           string // Absolute static dir, the prefix is stripped
+	Proxy         string // Upstream http(s)://host[:port], the full path is passed
+	Ratelimit     bool   // Ratelimit by IP
+	RatelimitRate int    // Requests per minute per IP (inherits the site's when 0)
+	Auth          bool   // Require Admin user+pass or Authlist IP
+	Gzip          bool   // Gzip responses
+}
 
-var (
+// Backends is a list of FastCGI addresses, in toml given as a single
+// string or an array. An address is host:port (tcp), tcp:host:port,
+// tcp6:[ip]:port, unix:/path/to.sock or an absolute socket path
+type Backends []string
+
+func (b *Backends) UnmarshalTOML(v interface{}) error {
+	switch t := v.(type) {
+	case string:
+		*b = Backends{t}
+	case []interface{}:
+		out := Backends{}
+		for _, addr := range t {
+			str, ok := addr.(string)
+			if !ok {
+				return fmt.Errorf("PHPFPM expects strings, given=%v", addr)
+			}
+			out = append(out, str)
+		}
+		*b = out
+	default:
+		return fmt.Errorf("PHPFPM expects string or array, given=%v", v)
+	}
+	return nil
+}
+
+// Global holds the server-wide settings from hfast.toml
+type Global struct {
+	PHPFPM          Backends      // Default FastCGI address(es) for sites
+	MaxWorkers      int           // Max connections per listener
+	CertDir         string        // LetsEncrypt certificate cache
+	QueueDB         string        // Boltdb path for /queue/
+	QueueListen     string        // Worker listener for /queue/
+	ReadTimeout     time.Duration // HTTP(S) server timeouts
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration  // Graceful shutdown
+	RatelimitRate   int            // Default PHP requests per minute per IP
+	FPMMaxIdle      int            // Idle keep-conn connections per PHP-FPM backend
+	FPMMaxOpen      int            // Max open connections per PHP-FPM backend (0=unlimited)
+	FPMIdleTimeout  time.Duration  // Close idle PHP-FPM connections after
+	Precompress     []string       // Default extensions with .br/.zst/.gz variants
+	CompressCache   int            // MB of memory for on-the-fly gzip of Precompress files (0=off)
+	ResizeCache     string         // Dir for images resized by /_resize/
+	HotCache        int            // MB of memory for small static files, inotify invalidated (0=off)
+	TrustedProxies  []string       // IPs/CIDRs whose X-Forwarded-For gives PHP the client IP
+	Trusted         []netip.Prefix `toml:"-"` // TrustedProxies parsed on load
+}
+
+// FPM returns the site's FastCGI address(es)
+func (o Override) FPM() Backends {
+	if len(o.PHPFPM) > 0 {
+		return o.PHPFPM
+	}
+	return Server.PHPFPM
+}
+
+// Rate returns the site's PHP requests per minute per IP
+func (o Override) Rate() int {
+	if o.RatelimitRate > 0 {
+		return o.RatelimitRate
+	}
+	return Server.RatelimitRate
+}
+
+// PrecompressExt returns the extensions checked for .br/.zst/.gz variants
+func (o Override) PrecompressExt() []string {
+	if len(o.Precompress) > 0 {
+		return o.Precompress
+	}
+	return Server.Precompress
+}
+
+// PrivateDir returns the dir PHP can hand files from with X-Sendfile
+func (o Override) PrivateDir(domain string) string {
+	if len(o.Private) > 0 {
+		return o.Private
+	}
+	return filepath.Join(Webdir, domain, "private")
+}
+
+// Protected returns the static prefixes behind Signed or AuthRequest
+func (o Override) Protected() []string {
+	out := append([]string{}, o.Signed...)
+	for prefix := range o.AuthRequest {
+		out = append(out, prefix)
+	}
+	return out
+}
+
+// Vhosts is one generation of the site tables, on reload a new
+// generation is built and swapped in as a whole
+type Vhosts struct {
 	Muxs      map[string]http.Handler
 	Langs     map[string]language.Matcher
 	Overrides map[string]Override
+	Errors    map[string]func(code int) []byte // Site's pub/_errors/<code>.html (nil when missing)
+	Hosts     []string                         // Domains (incl. www.) we accept certificates for
+	Queues    bool                             // Any site with SecretKey (queue enabled)
+}
+
+const MAX_WORKERS = 50000        // max 50k go-routines per listener
+const PHP_FPM = "127.0.0.1:8000" // default FPM path
+
+var (
+	vhosts atomic.Pointer[Vhosts]
+	Server Global
 
 	Verbose bool
 	Webdir  string
 )
 
 func init() {
-	Muxs = make(map[string]http.Handler)
-	Langs = make(map[string]language.Matcher)
-	Overrides = make(map[string]Override)
+	vhosts.Store(NewVhosts())
+	Server = DefaultGlobal()
+}
+
+// DefaultGlobal returns the settings used when hfast.toml is absent
+func DefaultGlobal() Global {
+	return Global{
+		PHPFPM:          Backends{PHP_FPM},
+		MaxWorkers:      MAX_WORKERS,
+		CertDir:         "/var/lib/hfast/certs",
+		QueueDB:         "/var/hfast.db",
+		QueueListen:     "localhost:11300",
+		ReadTimeout:     5 * time.Second,
+		WriteTimeout:    10 * time.Second,
+		IdleTimeout:     15 * time.Second,
+		ShutdownTimeout: 6 * time.Second,
+		RatelimitRate:   30,
+		FPMMaxIdle:      4,
+		FPMMaxOpen:      0,
+		FPMIdleTimeout:  30 * time.Second,
+		Precompress:     []string{".html", ".js", ".css", ".svg", ".json", ".xml", ".wasm", ".txt"},
+		CompressCache:   64,
+		ResizeCache:     "/var/cache/hfast/resize",
+		HotCache:        32,
+	}
+}
+
+func NewVhosts() *Vhosts {
+	return &Vhosts{
+		Muxs:      make(map[string]http.Handler),
+		Langs:     make(map[string]language.Matcher),
+		Overrides: make(map[string]Override),
+		Errors:    make(map[string]func(code int) []byte),
+	}
+}
+
+// Sites returns the active vhost generation, callers should
+// read it once per request so a reload mid-request is not noticed
+func Sites() *Vhosts {
+	return vhosts.Load()
+}
+
+// SetSites atomically replaces the active vhost generation
+func SetSites(v *Vhosts) {
+	vhosts.Store(v)
+}
+
+// Site is the vhost a request is routed to, carried on the request
+// context by handlers.Vhost so the whole request sees one generation
+type Site struct {
+	Domain   string // Host without www.
+	Override Override
+	Lang     language.Matcher      // nil without Lang
+	Errors   func(code int) []byte // nil without pub/_errors
+}
+
+type siteKey struct{}
+
+// WithSite returns ctx carrying site
+func WithSite(ctx context.Context, site Site) context.Context {
+	return context.WithValue(ctx, siteKey{}, site)
+}
+
+// Site returns the site of host in this generation
+func (v *Vhosts) Site(host string) (Site, bool) {
+	override, ok := v.Overrides[host]
+	return Site{Domain: host, Override: override, Lang: v.Langs[host], Errors: v.Errors[host]}, ok
+}
+
+// SiteOf returns the site r was routed to, outside handlers.Vhost
+// (tools, tests) it is looked up by r.Host
+func SiteOf(r *http.Request) (Site, bool) {
+	if site, ok := r.Context().Value(siteKey{}).(Site); ok {
+		return site, true
+	}
+	return Sites().Site(r.Host)
 }
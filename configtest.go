@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mpdroog/hfast/config"
+	"io"
+	"net"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// siteReport is the -t outcome for a single site
+type siteReport struct {
+	Site     string
+	Errors   []string
+	Warnings []string
+}
+
+// testReport is the -t outcome for the whole webroot
+type testReport struct {
+	Webdir   string
+	Sites    []siteReport
+	Errors   int
+	Warnings int
+}
+
+func (r *siteReport) errorf(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func (r *siteReport) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// fpmCheck dials every FastCGI address once per test-run
+type fpmCheck map[string]error
+
+func (c fpmCheck) dial(network, address string) error {
+	key := network + "://" + address
+	if e, ok := c[key]; ok {
+		return e
+	}
+	conn, e := net.DialTimeout(network, address, 2*time.Second)
+	if e == nil {
+		conn.Close()
+	}
+	c[key] = e
+	return e
+}
+
+// checkSite strictly validates a single site dir below config.Webdir
+func checkSite(domain string, fpm fpmCheck) siteReport {
+	r := siteReport{Site: domain, Errors: []string{}, Warnings: []string{}}
+	base := fmt.Sprintf(config.Webdir+"/%s", domain)
+
+	override, unknown, e := decodeOverride(base + "/override.toml")
+	if e != nil {
+		r.errorf("override.toml: %s", e.Error())
+		return r
+	}
+	for _, key := range unknown {
+		r.errorf("override.toml: unknown key %s", key)
+	}
+	for _, e := range validateOverride(override) {
+		r.errorf("%s", e.Error())
+	}
+
+	if ok, _ := exists(base + "/" + maintenanceFile); ok {
+		r.warnf("%s present (site in maintenance)", maintenanceFile)
+	}
+
+	if len(override.Proxy) > 0 {
+		// Proxy-mode ignores pub/action/admin
+		return r
+	}
+
+	archive := false
+	for _, name := range pubArchives {
+		if ok, _ := exists(base + "/" + name); ok {
+			archive = true
+			if a, e := openArchive(base + "/" + name); e != nil {
+				r.errorf("%s", e.Error())
+			} else {
+				a.f.Close()
+			}
+			break
+		}
+	}
+	if ok, _ := exists(base + "/pub"); !ok && !archive {
+		r.errorf("pub/ missing")
+	}
+	for _, dir := range override.Fallback {
+		if ok, _ := exists(dir); !ok && filepath.IsAbs(dir) {
+			r.errorf("Fallback(%s) missing", dir)
+		}
+	}
+	if domain == "default" {
+		return r
+	}
+
+	php := false
+	if ok, _ := exists(base + "/action/index.php"); ok {
+		php = true
+	} else if slices.Contains(override.TryFiles, "@php") {
+		r.errorf("action/index.php missing while TryFiles has @php")
+	} else {
+		r.warnf("action/index.php missing (PHP disabled)")
+	}
+	if len(override.Admin) > 0 {
+		php = true
+		if ok, _ := exists(base + "/admin/index.php"); !ok {
+			r.errorf("admin/index.php missing while Admin is set")
+		}
+	}
+
+	for _, prefix := range routePrefixes(override.Routes) {
+		route := override.Routes[prefix]
+		if len(route.PHP) > 0 {
+			php = true
+			if ok, _ := exists(filepath.Join(base, route.PHP)); !ok {
+				r.errorf("Routes[%s].PHP(%s) missing", prefix, route.PHP)
+			}
+		}
+		if len(route.Dir) > 0 && filepath.IsAbs(route.Dir) {
+			if ok, _ := exists(route.Dir); !ok {
+				r.errorf("Routes[%s].Dir(%s) missing", prefix, route.Dir)
+			}
+		}
+	}
+
+	for prefix, script := range override.AuthRequest {
+		php = true
+		if ok, _ := exists(filepath.Join(base, script)); !ok {
+			r.errorf("AuthRequest[%s](%s) missing", prefix, script)
+		}
+	}
+
+	if php {
+		for _, addr := range override.FPM() {
+			network, address, e := parseBackend(addr)
+			if e != nil {
+				if len(override.PHPFPM) == 0 {
+					// inherited from hfast.toml, site addresses are in validateOverride
+					r.errorf("hfast.%s", e.Error())
+				}
+				continue
+			}
+			if e := fpm.dial(network, address); e != nil {
+				r.errorf("PHP-FPM(%s) unreachable e=%s", addr, e.Error())
+			}
+		}
+	}
+	return r
+}
+
+// testConfig walks every site under config.Webdir and reports
+// all problems instead of stopping at the first one
+func testConfig() testReport {
+	out := testReport{Webdir: config.Webdir, Sites: []siteReport{}}
+
+	domains, e := getDomains()
+	if e != nil {
+		out.Sites = append(out.Sites, siteReport{Site: config.Webdir, Errors: []string{e.Error()}, Warnings: []string{}})
+		out.Errors++
+		return out
+	}
+
+	fpm := fpmCheck{}
+	for _, domain := range domains {
+		r := checkSite(domain, fpm)
+		out.Errors += len(r.Errors)
+		out.Warnings += len(r.Warnings)
+		out.Sites = append(out.Sites, r)
+	}
+	return out
+}
+
+// Write the report in human-readable or JSON form
+func (t testReport) Write(w io.Writer, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t)
+	}
+
+	for _, site := range t.Sites {
+		status := "OK"
+		if len(site.Errors) > 0 {
+			status = "ERR"
+		} else if len(site.Warnings) > 0 {
+			status = "WARN"
+		}
+		if _, e := fmt.Fprintf(w, "%s: %s\n", site.Site, status); e != nil {
+			return e
+		}
+		for _, msg := range site.Errors {
+			fmt.Fprintf(w, "  error: %s\n", msg)
+		}
+		for _, msg := range site.Warnings {
+			fmt.Fprintf(w, "  warn: %s\n", msg)
+		}
+	}
+	_, e := fmt.Fprintf(w, "%s: %d sites, %d errors, %d warnings\n", t.Webdir, len(t.Sites), t.Errors, t.Warnings)
+	return e
+}
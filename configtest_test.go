@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/mpdroog/hfast/config"
+	"os"
+	"testing"
+)
+
+func TestCheckSite(t *testing.T) {
+	webdir := config.Webdir
+	defer func() { config.Webdir = webdir }()
+	config.Webdir = t.TempDir()
+
+	if e := os.MkdirAll(config.Webdir+"/bad.com/pub", 0700); e != nil {
+		t.Fatal(e)
+	}
+	toml := "Ratelimt = true\nSiteType = \"wrong\"\nLang = [\"en\", \"!!\"]\nPprof = true\nProxy = \"127.0.0.1:3000\"\n"
+	if e := os.WriteFile(config.Webdir+"/bad.com/override.toml", []byte(toml), 0600); e != nil {
+		t.Fatal(e)
+	}
+	if e := os.MkdirAll(config.Webdir+"/good.com/pub", 0700); e != nil {
+		t.Fatal(e)
+	}
+
+	report := testConfig()
+	if len(report.Sites) != 2 {
+		t.Fatalf("expected 2 sites, got=%d", len(report.Sites))
+	}
+	bad := report.Sites[0]
+	if len(bad.Errors) != 5 {
+		t.Errorf("bad.com expected 5 errors, got=%+v", bad.Errors)
+	}
+	good := report.Sites[1]
+	if len(good.Errors) != 0 {
+		t.Errorf("good.com expected no errors, got=%+v", good.Errors)
+	}
+	if report.Errors != 5 {
+		t.Errorf("report.Errors expected 5, got=%d", report.Errors)
+	}
+}
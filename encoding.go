@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// contentCoding is a precompressed variant stored next to the file
+type contentCoding struct {
+	name string // Content-Encoding
+	ext  string // file suffix
+}
+
+// Precompressed variants in order of preference when the client
+// gives them the same q-value
+var contentCodings = []contentCoding{
+	{"br", ".br"},
+	{"zstd", ".zst"},
+	{"gzip", ".gz"},
+}
+
+// acceptEncoding parses Accept-Encoding into coding => q-value
+func acceptEncoding(h string) map[string]float64 {
+	out := parseQList(h)
+	if q, ok := out["x-gzip"]; ok {
+		if _, ok := out["gzip"]; !ok {
+			out["gzip"] = q
+		}
+	}
+	return out
+}
+
+// parseQList parses an Accept(-Encoding) style header into
+// value => q-value, entries with an invalid q-value are ignored
+func parseQList(h string) map[string]float64 {
+	out := make(map[string]float64)
+	for _, item := range strings.Split(h, ",") {
+		toks := strings.Split(item, ";")
+		value := strings.ToLower(strings.TrimSpace(toks[0]))
+		if value == "" {
+			continue
+		}
+
+		q := 1.0
+		valid := true
+		for _, param := range toks[1:] {
+			k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.ToLower(strings.TrimSpace(k)) != "q" {
+				continue
+			}
+			f, e := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if e != nil || f < 0 || f > 1 {
+				valid = false
+				break
+			}
+			q = f
+		}
+		if valid {
+			out[value] = q
+		}
+	}
+	return out
+}
+
+// qvalue returns how much the client accepts coding, an explicit
+// entry wins over the "*" wildcard
+func qvalue(accept map[string]float64, coding string) float64 {
+	if q, ok := accept[coding]; ok {
+		return q
+	}
+	if q, ok := accept["*"]; ok {
+		return q
+	}
+	return 0
+}
+
+// negotiateEncoding returns the best accepted coding that exists
+// as variant of name, ok is false when identity should be served
+func negotiateEncoding(accept map[string]float64, fs FileSystem, name string) (contentCoding, bool) {
+	best := contentCoding{}
+	bestQ := 0.0
+	for _, c := range contentCodings {
+		q := qvalue(accept, c.name)
+		if q <= bestQ {
+			continue
+		}
+		if ok, _ := fs.Exists(name + c.ext); ok {
+			best, bestQ = c, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// precompressable reports if name has one of exts
+func precompressable(exts []string, name string) bool {
+	for _, ext := range exts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePrecompress checks the Precompress extensions
+func validatePrecompress(exts []string) []error {
+	errs := []error{}
+	for _, ext := range exts {
+		if !strings.HasPrefix(ext, ".") || strings.Contains(ext, "/") {
+			errs = append(errs, fmt.Errorf("overrides.Precompress invalid, given=%s", ext))
+		}
+	}
+	return errs
+}
+
+// precompressed returns the file to serve for name, a precompressed
+// .br/.zst/.gz variant when the client accepts it. Revisioned names
+// (asset.v123.css) are mapped onto the real file.
+func precompressed(w http.ResponseWriter, r *http.Request, fs FileSystem, name string) string {
+	if rev := revisioned(name); rev != name {
+		if ok, _ := fs.Exists(rev); ok {
+			name = rev
+		}
+	}
+	if !precompressable(siteOf(r).PrecompressExt(), name) {
+		return name
+	}
+
+	// Response depends on Accept-Encoding, also for identity
+	w.Header().Add("Vary", "Accept-Encoding")
+	if c, ok := negotiateEncoding(acceptEncoding(r.Header.Get("Accept-Encoding")), fs, name); ok {
+		w.Header().Set("Content-Encoding", c.name)
+		name = name + c.ext
+	}
+	return name
+}
+
+// decodedName strips the variant suffix of the served Content-Encoding
+func decodedName(name, encoding string) string {
+	for _, c := range contentCodings {
+		if c.name == encoding {
+			return strings.TrimSuffix(name, c.ext)
+		}
+	}
+	return name
+}
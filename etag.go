@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Files above this size get a cheap weak size-mtime ETag instead of
+// a content hash (hashing would read the whole file on first request)
+const etagMaxHash = 32 * 1024 * 1024
+
+// Max remembered content hashes
+const etagCacheSize = 10000
+
+type etagKey struct {
+	root  string
+	name  string
+	size  int64
+	mtime int64
+}
+
+// etagCache remembers content hashes by (path, size, mtime) so
+// a file is only hashed again when it changed
+type etagCache struct {
+	mu sync.Mutex
+	m  map[etagKey]string
+}
+
+var etags = &etagCache{m: make(map[etagKey]string)}
+
+func (c *etagCache) get(k etagKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.m[k]
+	return v, ok
+}
+
+func (c *etagCache) set(k etagKey, v string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.m) >= etagCacheSize {
+		// Evict any, map order is random
+		for old := range c.m {
+			delete(c.m, old)
+			break
+		}
+	}
+	c.m[k] = v
+}
+
+// fsID distinguishes roots in the etag cache
+func fsID(fs FileSystem) string {
+	if s, ok := fs.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", fs)
+}
+
+// fileETag returns a strong content-hash ETag for name, precompressed
+// variants (.br/.gz) are separate files and so get their own ETag.
+// content is rewound to the start.
+func fileETag(fs FileSystem, name string, d os.FileInfo, content io.ReadSeeker) (string, error) {
+	if d.Size() > etagMaxHash {
+		return "W/\"" + strconv.FormatInt(d.Size(), 16) + "-" + strconv.FormatInt(d.ModTime().UnixNano(), 16) + "\"", nil
+	}
+
+	k := etagKey{root: fsID(fs), name: name, size: d.Size(), mtime: d.ModTime().UnixNano()}
+	if etag, ok := etags.get(k); ok {
+		return etag, nil
+	}
+
+	h := sha256.New()
+	if _, e := io.Copy(h, content); e != nil {
+		return "", e
+	}
+	if _, e := content.Seek(0, io.SeekStart); e != nil {
+		return "", e
+	}
+	etag := "\"" + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:18]) + "\""
+	etags.set(k, etag)
+	return etag, nil
+}
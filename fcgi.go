@@ -1,14 +1,167 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"github.com/mpdroog/hfast/config"
+	"github.com/mpdroog/hfast/handlers"
 	"github.com/yookoala/gofast"
+	"net"
 	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
 )
 
+// Params never passed from the client, internal or httpoxy
+var fcgiStripParams = []string{"HTTP_X_SECRETKEY", "HTTP_X_DOMAIN", "HTTP_PROXY"}
+
+// SSL_PROTOCOL names as mod_ssl
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// Valid Env names
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateEnv checks the site's Env names, HTTP_ is kept for headers
+func validateEnv(env map[string]string) []error {
+	errs := []error{}
+	for name := range env {
+		if !envName.MatchString(name) || strings.HasPrefix(strings.ToUpper(name), "HTTP_") {
+			errs = append(errs, fmt.Errorf("overrides.Env invalid name, given=%s", name))
+		}
+	}
+	return errs
+}
+
+// parseTrusted parses the TrustedProxies IPs/CIDRs
+func parseTrusted(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, p := range proxies {
+		prefix, e := parsePrefix(p)
+		if e != nil {
+			return nil, fmt.Errorf("TrustedProxies invalid, given=%s", p)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// parsePrefix parses a CIDR or a single IP
+func parsePrefix(p string) (netip.Prefix, error) {
+	if strings.Contains(p, "/") {
+		return netip.ParsePrefix(p)
+	}
+	ip, e := netip.ParseAddr(p)
+	if e != nil {
+		return netip.Prefix{}, e
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// trusted reports if ip is one of proxies
+func trusted(proxies []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range proxies {
+		if prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the client behind trusted proxies, the right-most
+// untrusted X-Forwarded-For entry
+func clientIP(r *http.Request, proxies []netip.Prefix) string {
+	host, _, e := net.SplitHostPort(r.RemoteAddr)
+	if e != nil {
+		return ""
+	}
+	ip, e := netip.ParseAddr(host)
+	if e != nil || !trusted(proxies, ip) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, e := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if e != nil {
+			break
+		}
+		ip = hop.Unmap()
+		if !trusted(proxies, ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// adminUser returns the Admin user when r carries valid credentials
+func adminUser(r *http.Request, admin map[string]string) string {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return ""
+	}
+	cfgPass, ok := admin[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(pass), []byte(cfgPass)) != 1 {
+		return ""
+	}
+	return user
+}
+
 func hfastMap(inner gofast.SessionHandler) gofast.SessionHandler {
 	return func(client gofast.Client, req *gofast.Request) (*gofast.ResponsePipe, error) {
 		r := req.Raw
+		override := siteOf(r)
+
+		for _, k := range fcgiStripParams {
+			delete(req.Params, k)
+		}
 		req.Params["SERVER_NAME"] = r.Host
+		req.Params["SERVER_SOFTWARE"] = "hfast"
+
+		// Scheme/port of the connection, not the (client given) Host
+		scheme, port := "http", "80"
+		if r.TLS != nil {
+			scheme, port = "https", "443"
+			req.Params["HTTPS"] = "on"
+			req.Params["SSL_PROTOCOL"] = tlsVersions[r.TLS.Version]
+			req.Params["SSL_CIPHER"] = tls.CipherSuiteName(r.TLS.CipherSuite)
+			req.Params["HFAST_ALPN"] = r.TLS.NegotiatedProtocol
+		}
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			if _, p, e := net.SplitHostPort(addr.String()); e == nil {
+				port = p
+			}
+		}
+		req.Params["REQUEST_SCHEME"] = scheme
+		req.Params["SERVER_PORT"] = port
+
+		id := handlers.RequestID(r)
+		if id == "" {
+			id = handlers.NewRequestID()
+		}
+		req.Params["HFAST_REQUEST_ID"] = id
+
+		if ip := clientIP(r, config.Server.Trusted); ip != "" {
+			req.Params["REMOTE_ADDR"] = ip
+		}
+		if user := adminUser(r, override.Admin); user != "" {
+			// PHP gets the user, not the password
+			req.Params["REMOTE_USER"] = user
+			req.Params["AUTH_TYPE"] = "Basic"
+			delete(req.Params, "HTTP_AUTHORIZATION")
+		}
+
+		// Site env, can't replace the params above
+		for k, v := range override.Env {
+			if _, ok := req.Params[k]; !ok {
+				req.Params[k] = v
+			}
+		}
 		return inner(client, req)
 	}
 }
@@ -27,19 +180,11 @@ func newFileEndpoint(endpointFile string) gofast.Middleware {
 // You'd need to start it with other means.
 //
 // docroot: the document root of the PHP site.
-// network: network protocol (tcp / tcp4 / tcp6)
-//
-//	or if it is a unix socket, "unix"
-//
-// address: IP address and port, or the socket physical address of the fastcgi
-//
-//	application.
-func NewHandler(docroot, network, address string) http.Handler {
-	connFactory := gofast.SimpleConnFactory("tcp", address)
-
+// upstream: the PHP-FPM backend(s), connections are pooled (keep-conn)
+func NewHandler(docroot string, upstream *fpmUpstream) http.Handler {
 	// route all requests to a single php file
 	return gofast.NewHandler(
 		newFileEndpoint(docroot)(gofast.BasicSession),
-		gofast.SimpleClientFactory(connFactory),
+		upstream.Client,
 	)
 }
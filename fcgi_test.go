@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/mpdroog/hfast/config"
+	"github.com/yookoala/gofast"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// fcgiParams returns the params PHP would get for r
+func fcgiParams(t *testing.T, r *gofast.Request) map[string]string {
+	var params map[string]string
+	h := gofast.Chain(gofast.BasicParamsMap, gofast.MapHeader, hfastMap)(func(client gofast.Client, req *gofast.Request) (*gofast.ResponsePipe, error) {
+		params = req.Params
+		return nil, nil
+	})
+	if _, e := h(nil, r); e != nil {
+		t.Fatal(e)
+	}
+	return params
+}
+
+func TestHfastMap(t *testing.T) {
+	old := config.Sites()
+	sites := config.NewVhosts()
+	sites.Overrides["example.com"] = config.Override{
+		Admin: map[string]string{"admin": "secret"},
+		Env:   map[string]string{"APP_ENV": "production", "HTTPS": "off"},
+	}
+	config.SetSites(sites)
+	defer config.SetSites(old)
+
+	oldProxies := config.Server.Trusted
+	config.Server.Trusted = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	defer func() { config.Server.Trusted = oldProxies }()
+
+	r := httptest.NewRequest("GET", "https://example.com/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256}
+	r.SetBasicAuth("admin", "secret")
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.2")
+	r.Header.Set("X-Secretkey", "leak")
+	r.Header.Set("Proxy", "http://evil")
+
+	params := fcgiParams(t, gofast.NewRequest(r))
+	expect := map[string]string{
+		"HTTPS":          "on",
+		"REQUEST_SCHEME": "https",
+		"SERVER_PORT":    "443",
+		"SERVER_NAME":    "example.com",
+		"SSL_PROTOCOL":   "TLSv1.3",
+		"SSL_CIPHER":     "TLS_AES_128_GCM_SHA256",
+		"REMOTE_ADDR":    "203.0.113.7",
+		"REMOTE_USER":    "admin",
+		"APP_ENV":        "production",
+	}
+	for k, v := range expect {
+		if params[k] != v {
+			t.Errorf("%s expect %s, got=%s", k, v, params[k])
+		}
+	}
+	for _, k := range []string{"HTTP_AUTHORIZATION", "HTTP_X_SECRETKEY", "HTTP_PROXY"} {
+		if _, ok := params[k]; ok {
+			t.Errorf("%s should not be passed", k)
+		}
+	}
+	if len(params["HFAST_REQUEST_ID"]) != 16 {
+		t.Errorf("HFAST_REQUEST_ID unexpected, got=%s", params["HFAST_REQUEST_ID"])
+	}
+
+	// Untrusted peer can't spoof its IP, wrong password keeps the header
+	r = httptest.NewRequest("GET", "http://example.com/", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.SetBasicAuth("admin", "wrong")
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	params = fcgiParams(t, gofast.NewRequest(r))
+	if params["REMOTE_ADDR"] != "198.51.100.1" || params["REQUEST_SCHEME"] != "http" || params["SERVER_PORT"] != "80" {
+		t.Errorf("unexpected params %v", params)
+	}
+	if _, ok := params["REMOTE_USER"]; ok || params["HTTP_AUTHORIZATION"] == "" {
+		t.Errorf("invalid credentials should not set REMOTE_USER")
+	}
+}
+
+func TestValidateEnv(t *testing.T) {
+	if errs := validateEnv(map[string]string{"APP_ENV": "production", "_x1": ""}); len(errs) > 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+	for _, name := range []string{"HTTP_HOST", "http_x", "1APP", "APP-ENV", ""} {
+		if errs := validateEnv(map[string]string{name: "x"}); len(errs) == 0 {
+			t.Errorf("expect error for %s", name)
+		}
+	}
+	if prefixes, e := parseTrusted([]string{"127.0.0.1", "10.0.0.0/8", "::1"}); e != nil || len(prefixes) != 3 || prefixes[0].Bits() != 32 {
+		t.Errorf("unexpected result %v %v", prefixes, e)
+	}
+	if _, e := parseTrusted([]string{"localhost"}); e == nil {
+		t.Errorf("expect error for localhost")
+	}
+}
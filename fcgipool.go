@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"github.com/yookoala/gofast"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Max time a request waits for a connection when FPMMaxOpen is reached
+const fpmWaitTimeout = 5 * time.Second
+
+// FastCGI record type that ends a request (FCGI_END_REQUEST)
+const fcgiEndRequest = 3
+
+func init() {
+	expvar.Publish("fpm", expvar.Func(fpmStats))
+}
+
+// fpmPool keeps idle keep-conn connections of a backend and caps the
+// amount of open ones. Please note every open connection (also idle)
+// keeps a PHP-FPM child busy, so keep FPMMaxIdle below pm.max_children
+type fpmPool struct {
+	mu          sync.Mutex
+	idle        []*fpmConn
+	open        int
+	maxIdle     int
+	maxOpen     int // 0=unlimited
+	idleTimeout time.Duration
+	waiters     []chan *fpmConn // nil conn hands over a slot to dial
+	closed      bool            // dropped on reload, nothing is kept idle
+	done        chan struct{}   // stops reap
+
+	dials     atomic.Int64
+	reused    atomic.Int64
+	waits     atomic.Int64
+	waitNanos atomic.Int64
+}
+
+func (p *fpmPool) init(maxIdle, maxOpen int, idleTimeout time.Duration) {
+	p.maxIdle = maxIdle
+	p.maxOpen = maxOpen
+	p.idleTimeout = idleTimeout
+	p.done = make(chan struct{})
+}
+
+// reap closes idle connections past idleTimeout until the backend is
+// closed, else they keep a PHP-FPM child busy until the next acquire
+func (b *fpmBackend) reap() {
+	t := time.NewTicker(max(b.pool.idleTimeout/2, time.Second))
+	defer t.Stop()
+	for {
+		select {
+		case <-b.pool.done:
+			return
+		case now := <-t.C:
+			b.reapIdle(now)
+		}
+	}
+}
+
+func (b *fpmBackend) reapIdle(now time.Time) {
+	p := &b.pool
+	p.mu.Lock()
+	expired := []*fpmConn{}
+	kept := p.idle[:0]
+	for _, c := range p.idle {
+		if now.Sub(c.idleSince) > p.idleTimeout {
+			expired = append(expired, c)
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	p.idle = kept
+	p.mu.Unlock()
+
+	for _, c := range expired {
+		b.discard(c)
+	}
+}
+
+// close drops the idle connections of a backend no site uses anymore,
+// in-flight ones are closed on release
+func (b *fpmBackend) close() {
+	p := &b.pool
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	close(p.done)
+	for _, c := range idle {
+		b.discard(c)
+	}
+}
+
+// acquire returns an idle connection or dials a new one
+func (b *fpmBackend) acquire() (*fpmConn, error) {
+	p := &b.pool
+	for {
+		p.mu.Lock()
+		if n := len(p.idle); n > 0 {
+			c := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.mu.Unlock()
+
+			if time.Since(c.idleSince) > p.idleTimeout || !c.alive() {
+				b.discard(c)
+				continue
+			}
+			p.reused.Add(1)
+			b.inUse.Add(1)
+			return c, nil
+		}
+
+		if p.maxOpen == 0 || p.open < p.maxOpen {
+			p.open++
+			p.mu.Unlock()
+			return b.connect()
+		}
+
+		// Wait for a release
+		ch := make(chan *fpmConn, 1)
+		p.waiters = append(p.waiters, ch)
+		p.mu.Unlock()
+		p.waits.Add(1)
+
+		begin := time.Now()
+		timer := time.NewTimer(fpmWaitTimeout)
+		select {
+		case c := <-ch:
+			timer.Stop()
+			p.waitNanos.Add(int64(time.Since(begin)))
+			if c == nil {
+				// Got a free slot
+				return b.connect()
+			}
+			b.inUse.Add(1)
+			return c, nil
+		case <-timer.C:
+			p.waitNanos.Add(int64(time.Since(begin)))
+			p.mu.Lock()
+			waiting := false
+			for i, w := range p.waiters {
+				if w == ch {
+					p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+					waiting = true
+					break
+				}
+			}
+			p.mu.Unlock()
+			if !waiting {
+				// Handed over right before the timeout, the send is underway
+				if c := <-ch; c != nil {
+					b.inUse.Add(1)
+					return c, nil
+				}
+				return b.connect()
+			}
+			return nil, fmt.Errorf("fpm(%s) no connection within %s (FPMMaxOpen=%d)", b.String(), fpmWaitTimeout, p.maxOpen)
+		}
+	}
+}
+
+// connect dials on a slot already counted in p.open
+func (b *fpmBackend) connect() (*fpmConn, error) {
+	conn, e := b.dial()
+	if e != nil {
+		b.freeSlot()
+		return nil, e
+	}
+	b.pool.dials.Add(1)
+	b.inUse.Add(1)
+
+	c := &fpmConn{Conn: conn, backend: b}
+	c.client, e = gofast.SimpleClientFactory(func() (net.Conn, error) { return c, nil })()
+	if e != nil {
+		b.inUse.Add(-1)
+		b.discard(c)
+		return nil, e
+	}
+	return c, nil
+}
+
+// release returns a connection after a request, only connections
+// that completed their FastCGI request are kept for reuse
+func (b *fpmBackend) release(c *fpmConn, reusable bool) {
+	b.inUse.Add(-1)
+	if !reusable {
+		b.discard(c)
+		return
+	}
+
+	p := &b.pool
+	p.mu.Lock()
+	if len(p.waiters) > 0 {
+		ch := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.mu.Unlock()
+		ch <- c
+		return
+	}
+	if len(p.idle) < p.maxIdle && !p.closed {
+		c.idleSince = time.Now()
+		p.idle = append(p.idle, c)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	b.discard(c)
+}
+
+// discard closes a connection and frees its slot
+func (b *fpmBackend) discard(c *fpmConn) {
+	c.Conn.Close()
+	b.freeSlot()
+}
+
+func (b *fpmBackend) freeSlot() {
+	p := &b.pool
+	p.mu.Lock()
+	if len(p.waiters) > 0 {
+		// Slot moves to the waiter, p.open stays the same
+		ch := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.mu.Unlock()
+		ch <- nil
+		return
+	}
+	p.open--
+	p.mu.Unlock()
+}
+
+// fpmConn is a pooled connection with its own gofast client, reads are
+// tracked to know when PHP-FPM ended the request (FCGI_END_REQUEST)
+type fpmConn struct {
+	net.Conn
+	backend   *fpmBackend
+	client    gofast.Client
+	idleSince time.Time
+
+	ended  atomic.Bool
+	hdr    [8]byte
+	hdrN   int
+	remain int
+}
+
+func (c *fpmConn) Read(p []byte) (int, error) {
+	n, e := c.Conn.Read(p)
+	c.track(p[:n])
+	return n, e
+}
+
+// track follows the FastCGI record boundaries in the read stream
+func (c *fpmConn) track(p []byte) {
+	for len(p) > 0 {
+		if c.remain == 0 {
+			n := copy(c.hdr[c.hdrN:], p)
+			c.hdrN += n
+			p = p[n:]
+			if c.hdrN < len(c.hdr) {
+				return
+			}
+			// contentLength + paddingLength
+			c.remain = int(binary.BigEndian.Uint16(c.hdr[4:6])) + int(c.hdr[6])
+			if c.remain == 0 {
+				c.recordDone()
+			}
+			continue
+		}
+
+		n := len(p)
+		if n > c.remain {
+			n = c.remain
+		}
+		c.remain -= n
+		p = p[n:]
+		if c.remain == 0 {
+			c.recordDone()
+		}
+	}
+}
+
+func (c *fpmConn) recordDone() {
+	if c.hdr[1] == fcgiEndRequest {
+		c.ended.Store(true)
+	}
+	c.hdrN = 0
+}
+
+// alive reports if an idle connection was not closed by PHP-FPM
+// (i.e. child reached pm.max_requests)
+func (c *fpmConn) alive() bool {
+	if e := c.Conn.SetReadDeadline(time.Now()); e != nil {
+		return false
+	}
+	var buf [1]byte
+	_, e := c.Conn.Read(buf[:])
+	if ne, ok := e.(net.Error); !ok || !ne.Timeout() {
+		// EOF, error or unexpected data
+		return false
+	}
+	return c.Conn.SetReadDeadline(time.Time{}) == nil
+}
+
+// pooledClient implements gofast.Client on a pooled connection, Close
+// returns the connection to the pool instead of closing it
+type pooledClient struct {
+	conn   *fpmConn
+	used   bool
+	failed bool
+}
+
+func (c *pooledClient) Do(req *gofast.Request) (*gofast.ResponsePipe, error) {
+	c.used = true
+	c.conn.ended.Store(false)
+	resp, e := c.conn.client.Do(req)
+	if e != nil {
+		c.failed = true
+	}
+	return resp, e
+}
+
+func (c *pooledClient) Close() error {
+	reusable := !c.used || (!c.failed && c.conn.ended.Load())
+	c.conn.backend.release(c.conn, reusable)
+	return nil
+}
+
+// fpmStat is the pool state of a single backend
+type fpmStat struct {
+	Open   int
+	InUse  int64
+	Idle   int
+	Failed bool
+	Dials  int64
+	Reused int64
+	Waits  int64
+	WaitMs int64 // total time spent waiting for a connection
+}
+
+// fpmStats returns the pool state of all backends (expvar "fpm")
+func fpmStats() interface{} {
+	fpmBackendsMu.Lock()
+	defer fpmBackendsMu.Unlock()
+
+	now := time.Now()
+	out := make(map[string]fpmStat)
+	for key, b := range fpmBackends {
+		b.pool.mu.Lock()
+		stat := fpmStat{
+			Open:   b.pool.open,
+			Idle:   len(b.pool.idle),
+			InUse:  b.inUse.Load(),
+			Failed: !b.healthy(now),
+			Dials:  b.pool.dials.Load(),
+			Reused: b.pool.reused.Load(),
+			Waits:  b.pool.waits.Load(),
+			WaitMs: time.Duration(b.pool.waitNanos.Load()).Milliseconds(),
+		}
+		b.pool.mu.Unlock()
+		out[key] = stat
+	}
+	return out
+}
+
+// FPMStats serves fpmStats as JSON
+func FPMStats() http.Handler {
+	return expvarHandler("fpm")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPoolReuse(t *testing.T) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ln.Close()
+	// net/http/fcgi honours FCGI_KEEP_CONN like PHP-FPM
+	go fcgi.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("Works!"))
+	}))
+
+	u, e := newUpstream([]string{ln.Addr().String()}, "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	h := NewHandler("/tmp/index.php", u)
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/action/", nil))
+		body, _ := io.ReadAll(w.Result().Body)
+		if w.Code != 200 || string(body) != "Works!" {
+			t.Fatalf("req(%d) code=%d body=%s", i, w.Code, string(body))
+		}
+	}
+
+	b := u.backends[0]
+	if n := b.pool.dials.Load(); n != 1 {
+		t.Errorf("expected 1 dial, got=%d", n)
+	}
+	if n := b.pool.reused.Load(); n != 4 {
+		t.Errorf("expected 4 reused, got=%d", n)
+	}
+	if n := b.inUse.Load(); n != 0 {
+		t.Errorf("expected 0 in use, got=%d", n)
+	}
+}
+
+func TestPoolMaxOpen(t *testing.T) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	b := &fpmBackend{network: "tcp", address: ln.Addr().String()}
+	b.pool.init(1, 1, fpmWaitTimeout)
+	first, e := b.acquire()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	done := make(chan *fpmConn)
+	go func() {
+		c, e := b.acquire()
+		if e != nil {
+			t.Error(e)
+		}
+		done <- c
+	}()
+	b.release(first, true)
+	if second := <-done; second != first {
+		t.Errorf("expected connection handed to waiter")
+	}
+	if b.pool.open != 1 {
+		t.Errorf("expected 1 open, got=%d", b.pool.open)
+	}
+}
+
+func TestPoolReapClose(t *testing.T) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	b := &fpmBackend{network: "tcp", address: ln.Addr().String()}
+	b.pool.init(2, 0, time.Minute)
+	first, e := b.acquire()
+	if e != nil {
+		t.Fatal(e)
+	}
+	second, e := b.acquire()
+	if e != nil {
+		t.Fatal(e)
+	}
+	b.release(first, true)
+	first.idleSince = time.Now().Add(-2 * time.Minute)
+	b.reapIdle(time.Now())
+	if b.pool.open != 1 || len(b.pool.idle) != 0 {
+		t.Errorf("expect expired idle connection closed, open=%d idle=%d", b.pool.open, len(b.pool.idle))
+	}
+
+	// Dropped on reload, in-flight connection isn't kept
+	b.close()
+	b.release(second, true)
+	if b.pool.open != 0 || len(b.pool.idle) != 0 {
+		t.Errorf("expect closed backend to keep nothing, open=%d idle=%d", b.pool.open, len(b.pool.idle))
+	}
+}
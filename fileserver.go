@@ -4,10 +4,15 @@
 
 // Cherry picked from golang source.
 // Diff compared to original:
-// - Directory listing always returns forbidden
+// - Directory listing returns forbidden unless enabled (Listing in override.toml)
 // - Reject requests containig dot (i.e. .git .htaccess etc..)
 // - Static assets (.gif .jpg etc) automatically get Cache-Control header
-// - If file.gz or file.bz exists serve that as file
+//   (CacheRules in override.toml)
+// - If file.br, file.zst or file.gz exists serve that as file (q-value
+//   negotiated, Vary: Accept-Encoding), else gzip on the fly (cached)
+// - Images get their .avif/.webp variant when in Accept (Vary: Accept)
+// - FileSystem can be layered (overlayFS), variants stay within a layer
+// - Strong content-hash ETags (cached by path, size and mtime)
 //
 // HTTP file system http.Request handler
 
@@ -17,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/mpdroog/hfast/config"
+	"github.com/mpdroog/hfast/handlers"
 	"github.com/mpdroog/hfast/logger"
 	"io"
 	"mime"
@@ -90,6 +96,11 @@ func (d Dir) Open(name string) (File, error) {
 	return f, nil
 }
 
+// String identifies the root (i.e. for the etag cache)
+func (d Dir) String() string {
+	return string(d)
+}
+
 func (d Dir) Exists(name string) (bool, error) {
 	if filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) {
 		return false, errors.New("http: invalid character in file path: " + name)
@@ -124,10 +135,6 @@ type File interface {
 	Stat() (os.FileInfo, error)
 }
 
-func dirList(w http.ResponseWriter, r *http.Request, f File) {
-	http.Error(w, "Action prohibited.", http.StatusForbidden)
-}
-
 // ServeContent replies to the http.Request using the content in the
 // provided ReadSeeker. The main benefit of ServeContent over io.Copy
 // is that it handles Range http.Requests properly, sets the MIME type, and
@@ -190,23 +197,18 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 	}
 
 	code := http.StatusOK
-	if _, ok := config.Overrides[r.Host]; !ok && r.URL.Path == "/" {
+	site, ok := config.SiteOf(r)
+	override := site.Override
+	if !ok && r.URL.Path == "/" {
 		// mpdroog: Default to notfound to clarify to any caller the given URL is invalid
 		code = http.StatusNotFound
 	}
 
-	if strings.HasSuffix(r.URL.Path, ".html") || r.URL.Path == "/" {
-		// Force browser to check for HTML change
-		w.Header().Set("Cache-Control", "no-cache,no-store,must-revalidate")
-	}
-
-	if strings.HasSuffix(r.URL.Path, ".css") ||
-		strings.HasSuffix(r.URL.Path, ".js") ||
-		strings.HasSuffix(r.URL.Path, ".png") ||
-		strings.HasSuffix(r.URL.Path, ".gif") ||
-		strings.HasSuffix(r.URL.Path, ".jpg") {
-		// Force browser to cache this one month
-		w.Header().Set("Cache-Control", "public,max-age=2678400")
+	// Wrappers (Signed, AuthRequest, Sendfile) decide themselves
+	if w.Header().Get("Cache-Control") == "" {
+		if cc := cacheControl(override.CacheRules, r.URL.Path); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
 	}
 
 	// If Content-Type isn't set, use the file's extension to find it, but
@@ -214,12 +216,8 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 	ctypes, haveType := w.Header()["Content-Type"]
 	var ctype string
 	if !haveType {
-		if strings.HasSuffix(name, ".gz") {
-			name = strings.Replace(name, ".gz", "", 1)
-		}
-		if strings.HasSuffix(name, ".br") {
-			name = strings.Replace(name, ".br", "", 1)
-		}
+		// Type of the original file, not the .br/.zst/.gz variant
+		name = decodedName(name, w.Header().Get("Content-Encoding"))
 		ctype = mime.TypeByExtension(filepath.Ext(name))
 		if ctype == "" {
 			// read a chunk to decide between utf-8 text and binary
@@ -228,7 +226,7 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 			ctype = http.DetectContentType(buf[:n])
 			_, err := content.Seek(0, io.SeekStart) // rewind to output whole file
 			if err != nil {
-				http.Error(w, "seeker can't seek", http.StatusInternalServerError)
+				handlers.Error(w, r, http.StatusInternalServerError)
 				return
 			}
 		}
@@ -239,7 +237,8 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 
 	size, err := sizeFunc()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Printf("serveContent(%s) e=%s", name, err.Error())
+		handlers.Error(w, r, http.StatusInternalServerError)
 		return
 	}
 
@@ -313,10 +312,10 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 			}()
 		}
 
+		// Ranges (and Content-Length) apply to the encoded
+		// representation when serving a precompressed variant
 		w.Header().Set("Accept-Ranges", "bytes")
-		if w.Header().Get("Content-Encoding") == "" {
-			w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
-		}
+		w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
 	}
 
 	w.WriteHeader(code)
@@ -585,44 +584,13 @@ func revisioned(name string) string {
 	return name
 }
 
-func precompressed(w http.ResponseWriter, r *http.Request, fs FileSystem, name string) string {
-	if strings.HasSuffix(name, ".html") || strings.HasSuffix(name, ".js") || strings.HasSuffix(name, ".css") {
-		name = revisioned(name)
-		useGzip := false
-		useBrotli := false
-
-		encs := strings.SplitN(r.Header.Get("accept-encoding"), ",", 10)
-		for _, enc := range encs {
-			enc = strings.TrimSpace(strings.ToLower(enc))
-			if enc == "gzip" {
-				if ok, _ := fs.Exists(name + ".gz"); ok {
-					useGzip = true
-				}
-			}
-			if enc == "br" {
-				if ok, _ := fs.Exists(name + ".br"); ok {
-					useBrotli = true
-				}
-			}
-		}
-		if useBrotli {
-			w.Header().Set("Content-Encoding", "br")
-			name = name + ".br"
-		} else if useGzip {
-			w.Header().Set("Content-Encoding", "gzip")
-			name = name + ".gz"
-		}
-	}
-	return name
-}
-
 // name is '/'-separated, not filepath.Separator.
 func serveFile(w http.ResponseWriter, r *http.Request, fs FileSystem, name string, redirect bool) {
 	const indexPage = "/index.html"
 
 	if strings.Contains(r.URL.Path, "/.") {
 		// mpdroog: Don't allow dot prefixed paths (.git, .htaccess etc..)
-		http.Error(w, "Action prohibited.", http.StatusForbidden)
+		handlers.Error(w, r, http.StatusForbidden)
 		return
 	}
 
@@ -635,23 +603,26 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs FileSystem, name strin
 	}
 	// mpdroog: Protect user against himself
 	if strings.HasSuffix(name, ".php") {
-		http.Error(w, "Action prohibited.", http.StatusForbidden)
+		handlers.Error(w, r, http.StatusForbidden)
 		return
 	}
 
+	// Variants come from the layer holding the file (overlayFS)
+	fs = fileLayer(fs, name)
 	name = precompressed(w, r, fs, name)
+	name = imageVariant(w, r, fs, name)
 	f, err := fs.Open(name)
 	if err != nil {
-		msg, code := toHTTPError(err)
-		http.Error(w, msg, code)
+		_, code := toHTTPError(err)
+		handlers.Error(w, r, code)
 		return
 	}
 	defer f.Close()
 
 	d, err := f.Stat()
 	if err != nil {
-		msg, code := toHTTPError(err)
-		http.Error(w, msg, code)
+		_, code := toHTTPError(err)
+		handlers.Error(w, r, code)
 		return
 	}
 
@@ -684,8 +655,9 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs FileSystem, name strin
 	// use contents of index.html for directory, if present
 	if d.IsDir() {
 		index := strings.TrimSuffix(name, "/") + indexPage
-		index = precompressed(w, r, fs, index)
-		ff, err := fs.Open(index)
+		ifs := fileLayer(fs, index)
+		index = precompressed(w, r, ifs, index)
+		ff, err := ifs.Open(index)
 		if err == nil {
 			defer ff.Close()
 			dd, err := ff.Stat()
@@ -693,16 +665,41 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs FileSystem, name strin
 				name = index
 				d = dd
 				f = ff
+				fs = ifs
 			}
 		}
 	}
 
 	// Still a directory? (we didn't find an index.html file)
 	if d.IsDir() {
-		http.Error(w, "Action prohibited.", http.StatusForbidden)
+		if listingEnabled(siteOf(r).Listing, r.URL.Path) {
+			dirList(w, r, fs, name)
+			return
+		}
+		handlers.Error(w, r, http.StatusForbidden)
+		return
+	}
+
+	// Hot cache knows the Content-Type already, unless a variant
+	// replaces the requested file
+	if mf, ok := f.(*memFile); ok && mf.ctype != "" && w.Header().Get("Content-Type") == "" && w.Header().Get("Content-Encoding") == "" {
+		w.Header().Set("Content-Type", mf.ctype)
+	}
+
+	if serveCompressed(w, r, fs, name, d, f) {
 		return
 	}
 
+	if w.Header().Get("Etag") == "" {
+		etag, err := fileETag(fs, name, d, f)
+		if err != nil {
+			_, code := toHTTPError(err)
+			handlers.Error(w, r, code)
+			return
+		}
+		w.Header().Set("Etag", etag)
+	}
+
 	// serveContent will check modification time
 	sizeFunc := func() (int64, error) { return d.Size(), nil }
 	serveContent(w, r, d.Name(), d.ModTime(), sizeFunc, f)
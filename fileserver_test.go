@@ -1,12 +1,21 @@
 package main
 
 import (
+	"compress/gzip"
+	"container/list"
 	"crypto/rand"
 	"fmt"
+	"github.com/mpdroog/hfast/handlers"
 	"io/ioutil"
 	"log"
 	mbig "math/big"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -27,8 +36,13 @@ func init() {
 
 	server = &http.Server{Addr: fmt.Sprintf("127.0.0.1:%d", d), Handler: http.DefaultServeMux}
 	//defer server.Close()
+	// Listen before returning so tests never race the server start
+	ln, e := net.Listen("tcp", server.Addr)
+	if e != nil {
+		log.Fatal(e)
+	}
 	go func() {
-		e := server.ListenAndServe()
+		e := server.Serve(ln)
 		if e != nil {
 			panic(e)
 		}
@@ -63,7 +77,7 @@ func TestIndex(t *testing.T) {
 	if e != nil {
 		log.Fatal(e)
 	}
-	if string(body) != "Action prohibited.\n" {
+	if !strings.Contains(string(body), "403 Forbidden") {
 		log.Printf("Err, prohibit-msg not shows, body=%s", string(body))
 	}
 }
@@ -81,7 +95,7 @@ func TestDotPrefixed(t *testing.T) {
 	if e != nil {
 		log.Fatal(e)
 	}
-	if string(body) != "Action prohibited.\n" {
+	if !strings.Contains(string(body), "403 Forbidden") {
 		log.Printf("Err, prohibit-msg not shows, body=%s", string(body))
 	}
 }
@@ -117,7 +131,7 @@ func TestDotDir(t *testing.T) {
 	if e != nil {
 		log.Fatal(e)
 	}
-	if string(body) != "Action prohibited.\n" {
+	if !strings.Contains(string(body), "403 Forbidden") {
 		log.Printf("Err, prohibit-msg not shows, body=%s", string(body))
 	}
 }
@@ -153,7 +167,7 @@ func TestPHP(t *testing.T) {
 	if e != nil {
 		log.Fatal(e)
 	}
-	if string(body) != "Action prohibited.\n" {
+	if !strings.Contains(string(body), "403 Forbidden") {
 		log.Printf("Err, prohibit-msg not shows, body=%s", string(body))
 	}
 }
@@ -172,3 +186,331 @@ func TestRevisioned(t *testing.T) {
 		}
 	}
 }
+
+func TestETag(t *testing.T) {
+	res, e := call("/safe/file.txt")
+	if e != nil {
+		t.Fatal(e)
+	}
+	res.Body.Close()
+	etag := res.Header.Get("Etag")
+	if etag == "" || etag[0] != '"' {
+		t.Fatalf("expected strong ETag, got=%s", etag)
+	}
+
+	req, e := http.NewRequest(http.MethodGet, "http://"+server.Addr+"/safe/file.txt", nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	req.Header.Set("If-None-Match", etag)
+	res, e = client.Do(req)
+	if e != nil {
+		t.Fatal(e)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match expected 304, got=%d", res.StatusCode)
+	}
+	if res.Header.Get("Etag") != etag {
+		t.Errorf("304 ETag mismatch %s!=%s", res.Header.Get("Etag"), etag)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	rules := map[string]string{
+		".svg":            "public,max-age=86400",
+		"*.woff2":         "public,max-age=31536000",
+		"/downloads/":     "no-store",
+		"/downloads/*.js": "public,max-age=60",
+	}
+	m := map[string]string{
+		"/":                   "no-cache,no-store,must-revalidate",
+		"/index.html":         "no-cache,no-store,must-revalidate",
+		"/style.css":          "public,max-age=2678400",
+		"/style.v123.css":     "public,max-age=2678400,immutable",
+		"/logo.svg":           "public,max-age=86400",
+		"/logo.v9.svg":        "public,max-age=86400,immutable",
+		"/fonts/a.woff2":      "public,max-age=31536000",
+		"/downloads/file.zip": "no-store",
+		"/downloads/app.js":   "public,max-age=60",
+		"/data.json":          "",
+	}
+	for in, out := range m {
+		if got := cacheControl(rules, in); got != out {
+			t.Errorf("cacheControl(%s) expect=%s got=%s", in, out, got)
+		}
+	}
+
+	if got := cacheControl(nil, "/app.v1.js"); got != "public,max-age=2678400,immutable" {
+		t.Errorf("default revisioned expect immutable, got=%s", got)
+	}
+	if errs := validateCacheRules(map[string]string{"[": "no-store"}); len(errs) != 1 {
+		t.Errorf("expected invalid pattern error")
+	}
+}
+
+func TestAcceptEncoding(t *testing.T) {
+	accept := acceptEncoding("gzip, br;q=0, zstd;q=0.5, *;q=0.1, bogus;q=x")
+	m := map[string]float64{
+		"gzip":     1,
+		"br":       0,
+		"zstd":     0.5,
+		"compress": 0.1,
+		"bogus":    0.1,
+	}
+	for coding, q := range m {
+		if got := qvalue(accept, coding); got != q {
+			t.Errorf("qvalue(%s) expect=%v got=%v", coding, q, got)
+		}
+	}
+}
+
+func TestPrecompressed(t *testing.T) {
+	m := map[string]string{
+		"":                 "",
+		"gzip, br":         "br",
+		"gzip, br;q=0":     "gzip",
+		"br;q=0.5, gzip":   "gzip",
+		"zstd":             "",
+		"*":                "br",
+		"gzip;q=0, br;q=0": "",
+		"x-gzip, identity": "gzip",
+	}
+	for accept, enc := range m {
+		req, e := http.NewRequest(http.MethodGet, "http://"+server.Addr+"/safe/app.js", nil)
+		if e != nil {
+			t.Fatal(e)
+		}
+		// Prevent the transport from adding (and decoding) gzip
+		req.Header.Set("Accept-Encoding", accept)
+		if accept == "" {
+			req.Header.Set("Accept-Encoding", "identity")
+		}
+		res, e := client.Do(req)
+		if e != nil {
+			t.Fatal(e)
+		}
+		res.Body.Close()
+		if got := res.Header.Get("Content-Encoding"); got != enc {
+			t.Errorf("Accept-Encoding=%s expect=%s got=%s", accept, enc, got)
+		}
+		if res.Header.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding=%s missing Vary", accept)
+		}
+		if res.Header.Get("Content-Type") != "text/javascript; charset=utf-8" {
+			t.Errorf("Accept-Encoding=%s Content-Type=%s", accept, res.Header.Get("Content-Type"))
+		}
+	}
+
+	// Range applies to the encoded representation
+	req, e := http.NewRequest(http.MethodGet, "http://"+server.Addr+"/safe/app.js", nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	req.Header.Set("Accept-Encoding", "br")
+	req.Header.Set("Range", "bytes=0-5")
+	res, e := client.Do(req)
+	if e != nil {
+		t.Fatal(e)
+	}
+	body, e := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if res.StatusCode != http.StatusPartialContent || string(body) != "BROTLI" {
+		t.Errorf("Range expect 206 BROTLI, got=%d %s", res.StatusCode, body)
+	}
+	if res.Header.Get("Content-Range") != "bytes 0-5/12" || res.Header.Get("Content-Length") != "6" {
+		t.Errorf("Range headers Content-Range=%s Content-Length=%s", res.Header.Get("Content-Range"), res.Header.Get("Content-Length"))
+	}
+}
+
+func TestCompressOnTheFly(t *testing.T) {
+	orig, e := ioutil.ReadFile("./testdata/safe/lorem.txt")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	for i := 0; i < 2; i++ {
+		req, e := http.NewRequest(http.MethodGet, "http://"+server.Addr+"/safe/lorem.txt", nil)
+		if e != nil {
+			t.Fatal(e)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, e := client.Do(req)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if res.Header.Get("Content-Encoding") != "gzip" || res.Header.Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("expected gzip with Vary, got=%v", res.Header)
+		}
+		if !strings.HasSuffix(res.Header.Get("Etag"), "-gzip\"") {
+			t.Errorf("expected gzip ETag, got=%s", res.Header.Get("Etag"))
+		}
+		gz, e := gzip.NewReader(res.Body)
+		if e != nil {
+			t.Fatal(e)
+		}
+		body, e := ioutil.ReadAll(gz)
+		res.Body.Close()
+		if e != nil {
+			t.Fatal(e)
+		}
+		if string(body) != string(orig) {
+			t.Errorf("decoded body mismatch")
+		}
+		if res.ContentLength <= 0 || res.ContentLength >= int64(len(orig)) {
+			t.Errorf("unexpected Content-Length=%d", res.ContentLength)
+		}
+	}
+
+	req, e := http.NewRequest(http.MethodGet, "http://"+server.Addr+"/safe/lorem.txt", nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-1")
+	res, e := client.Do(req)
+	if e != nil {
+		t.Fatal(e)
+	}
+	body, e := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if e != nil {
+		t.Fatal(e)
+	}
+	// gzip magic
+	if res.StatusCode != http.StatusPartialContent || string(body) != "\x1f\x8b" {
+		t.Errorf("Range expect 206 gzip magic, got=%d %x", res.StatusCode, body)
+	}
+}
+
+func TestCompressCacheStale(t *testing.T) {
+	c := &compressCache{
+		lru:    list.New(),
+		keys:   make(map[compressKey]*list.Element),
+		latest: make(map[compressName]compressKey),
+		calls:  make(map[compressKey]*compressCall),
+	}
+	n := compressName{root: "test", name: "/a.css", coding: "gzip"}
+	old := compressKey{compressName: n, size: 10, mtime: 1}
+	cur := compressKey{compressName: n, size: 12, mtime: 2}
+
+	c.set(old, []byte("old"))
+	c.set(cur, []byte("new"))
+	if _, ok := c.get(old); ok {
+		t.Errorf("stale entry still cached")
+	}
+	if data, ok := c.get(cur); !ok || string(data) != "new" {
+		t.Errorf("current entry missing")
+	}
+	if c.bytes != 3 || c.lru.Len() != 1 {
+		t.Errorf("unexpected accounting bytes=%d len=%d", c.bytes, c.lru.Len())
+	}
+}
+
+func TestImageVariant(t *testing.T) {
+	m := map[string][]string{
+		"/safe/photo.jpg|image/avif,image/webp,*/*;q=0.8": {"AVIF", "image/avif", "Accept"},
+		"/safe/photo.jpg|image/avif;q=0.5,image/webp":     {"WEBP", "image/webp", "Accept"},
+		"/safe/photo.jpg|image/webp,*/*":                  {"WEBP", "image/webp", "Accept"},
+		"/safe/photo.jpg|*/*":                             {"JPEG", "image/jpeg", "Accept"},
+		"/safe/photo.v12.jpg|image/webp":                  {"WEBP", "image/webp", "Accept"},
+		"/safe/plain.png|image/avif,image/webp":           {"PNG", "image/png", ""},
+	}
+	for in, out := range m {
+		toks := strings.SplitN(in, "|", 2)
+		req, e := http.NewRequest(http.MethodGet, "http://"+server.Addr+toks[0], nil)
+		if e != nil {
+			t.Fatal(e)
+		}
+		req.Header.Set("Accept", toks[1])
+		res, e := client.Do(req)
+		if e != nil {
+			t.Fatal(e)
+		}
+		body, e := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if e != nil {
+			t.Fatal(e)
+		}
+		if string(body) != out[0] || res.Header.Get("Content-Type") != out[1] {
+			t.Errorf("%s expect=%v got=%s %s", in, out, body, res.Header.Get("Content-Type"))
+		}
+		if res.Header.Get("Vary") != out[2] {
+			t.Errorf("%s expect Vary=%s, got=%s", in, out[2], res.Header.Get("Vary"))
+		}
+	}
+}
+
+func TestCompressCacheLoad(t *testing.T) {
+	c := &compressCache{
+		lru:    list.New(),
+		keys:   make(map[compressKey]*list.Element),
+		latest: make(map[compressName]compressKey),
+		calls:  make(map[compressKey]*compressCall),
+	}
+	k := compressKey{compressName: compressName{root: "test", name: "/a.css", coding: "gzip"}, size: 10, mtime: 1}
+
+	var calls int32
+	release := make(chan struct{})
+	fn := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []byte("small"), nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, e := c.load(k, 10, fn); e != nil || string(data) != "small" {
+				t.Errorf("unexpected load %s %v", data, e)
+			}
+		}()
+	}
+	for {
+		c.mu.Lock()
+		_, started := c.calls[k]
+		c.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("expect one compression, got=%d", calls)
+	}
+	if _, ok := c.get(k); !ok {
+		t.Errorf("expect cached result")
+	}
+
+	// Output not smaller than the file isn't kept
+	big := compressKey{compressName: compressName{root: "test", name: "/b.png", coding: "gzip"}, size: 4, mtime: 1}
+	if _, e := c.load(big, 4, func() ([]byte, error) { return []byte("larger"), nil }); e != nil {
+		t.Fatal(e)
+	}
+	if _, ok := c.get(big); ok {
+		t.Errorf("incompressible result cached")
+	}
+}
+
+func TestSignedCacheControl(t *testing.T) {
+	pub := t.TempDir()
+	if e := os.MkdirAll(filepath.Join(pub, "invoices"), 0755); e != nil {
+		t.Fatal(e)
+	}
+	if e := os.WriteFile(filepath.Join(pub, "invoices", "scan.png"), []byte("png"), 0644); e != nil {
+		t.Fatal(e)
+	}
+
+	h := handlers.Signed(FileServer(Dir(pub)), []string{"/invoices/"}, "secret")
+	link := handlers.SignURL("secret", "/invoices/scan.png", time.Now().Add(time.Hour))
+	w := archiveGet(t, h, link, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "private" {
+		t.Errorf("signed png expect private, got=%d %s", w.Code, w.Header().Get("Cache-Control"))
+	}
+}
@@ -2,7 +2,11 @@
 package handlers
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"github.com/mpdroog/hfast/config"
 	"github.com/mpdroog/hfast/logger"
 	"io"
 	"net/http"
@@ -52,6 +56,7 @@ type Msg struct {
 	Date      string
 	Time      string
 	Referer   string
+	RequestID string
 }
 
 type statusWriter struct {
@@ -78,10 +83,39 @@ func (w *statusWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// ReadFrom keeps the zero-copy (sendfile) path of the server for files
+func (w *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.Status == 0 {
+		w.Status = 200
+	}
+	n, err := io.Copy(w.ResponseWriter, src)
+	w.Length += uint64(n)
+	return n, err
+}
+
+type requestIDKey struct{}
+
+// RequestID returns the id of r in the access log ("" outside AccessLog)
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+func NewRequestID() string {
+	var b [8]byte
+	if _, e := rand.Read(b[:]); e != nil {
+		logger.Printf("accesslog: " + e.Error())
+	}
+	return hex.EncodeToString(b[:])
+}
+
 func AccessLog(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		begin := time.Now()
 		sw := &statusWriter{ResponseWriter: w}
+		if RequestID(r) == "" {
+			r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, NewRequestID()))
+		}
 		h.ServeHTTP(sw, r)
 
 		// Devnote: Be careful to overwrite EVERY field else you
@@ -89,7 +123,12 @@ func AccessLog(h http.Handler) http.Handler {
 		diff := time.Since(begin)
 		msg := msgPool.Get()
 		msg.Method = r.Method
-		msg.Host = r.Host
+		if site, ok := config.SiteOf(r); ok {
+			msg.Host = site.Domain
+		} else {
+			// Default mux and unknown hosts
+			msg.Host = r.Host
+		}
 		msg.URL = r.URL.String()
 		msg.Status = sw.Status
 		msg.Remote = r.RemoteAddr
@@ -101,6 +140,7 @@ func AccessLog(h http.Handler) http.Handler {
 		msg.Date = begin.Format("2006-01-02")
 		msg.Time = begin.Format("15:04:05")
 		msg.Referer = r.Referer()
+		msg.RequestID = RequestID(r)
 
 		if e := enc.Encode(msg); e != nil {
 			logger.Printf("accesslog: " + e.Error())
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/mpdroog/hfast/config"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessLogHost(t *testing.T) {
+	buf := &bytes.Buffer{}
+	SetLog(buf)
+	defer SetLog(io.Discard)
+	sites := config.NewVhosts()
+	sites.Overrides["example.com"] = config.Override{}
+	config.SetSites(sites)
+	defer config.SetSites(config.NewVhosts())
+
+	h := AccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := map[string]string{
+		"http://example.com/":    "example.com",
+		"http://unknown.com:80/": "unknown.com:80",
+	}
+	for url, host := range tests {
+		buf.Reset()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+		msg := Msg{}
+		if e := json.Unmarshal(buf.Bytes(), &msg); e != nil {
+			t.Fatal(e)
+		}
+		if msg.Host != host {
+			t.Errorf("%s expect Host=%s, got=%s", url, host, msg.Host)
+		}
+	}
+}
@@ -55,3 +55,21 @@ func BasicAuth(h http.Handler, realm string, userpass map[string]string, authlis
 		h.ServeHTTP(w, r)
 	})
 }
+
+// Allowed reports if r passes BasicAuth (whitelisted IP or valid
+// user+pass) without asking for credentials
+func Allowed(r *http.Request, userpass map[string]string, authlist map[string]bool) bool {
+	host, _, e := net.SplitHostPort(r.RemoteAddr)
+	if e != nil {
+		return false
+	}
+	if whitelist, ok := authlist[host]; ok {
+		return whitelist
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	cfgPass, ok := userpass[user]
+	return ok && subtle.ConstantTimeCompare([]byte(pass), []byte(cfgPass)) == 1
+}
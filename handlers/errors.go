@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mpdroog/hfast/config"
+	"github.com/mpdroog/hfast/logger"
+	"html"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Built-in explanation per status, others only get the status text
+var errorHints = map[int]string{
+	http.StatusForbidden:           "You don't have permission to access this page.",
+	http.StatusNotFound:            "The page you are looking for doesn't exist or has moved.",
+	http.StatusTooManyRequests:     "Too many requests, please wait a moment and try again.",
+	http.StatusInternalServerError: "Something went wrong on our side, it has been reported.",
+	http.StatusBadGateway:          "The application behind this site is not responding.",
+	http.StatusServiceUnavailable:  "This site is temporarily unavailable, please try again later.",
+}
+
+// Built-in page, no inline CSS/JS so it passes the CSP
+const errorTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>%d %s</title>
+</head>
+<body>
+<h1>%d %s</h1>
+<p>%s</p>
+<hr>
+<p><small>HFast</small></p>
+</body>
+</html>
+`
+
+// Error writes the error page for code: the site's pub/_errors/<code>.html,
+// a built-in page when missing, or JSON when the client prefers it
+func Error(w http.ResponseWriter, r *http.Request, code int) {
+	h := w.Header()
+	for _, k := range []string{"Content-Length", "Content-Encoding", "Etag", "Last-Modified"} {
+		h.Del(k)
+	}
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	if WantsJSON(r) {
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if e := json.NewEncoder(w).Encode(map[string]interface{}{"status": code, "error": http.StatusText(code)}); e != nil {
+			logger.Printf("handlers.Error e=%s", e.Error())
+		}
+		return
+	}
+
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	if r.Method == "HEAD" {
+		return
+	}
+	page := sitePage(r, code)
+	if page == nil {
+		text := html.EscapeString(http.StatusText(code))
+		page = []byte(fmt.Sprintf(errorTemplate, code, text, code, text, html.EscapeString(errorHints[code])))
+	}
+	if _, e := w.Write(page); e != nil {
+		logger.Printf("handlers.Error e=%s", e.Error())
+	}
+}
+
+// sitePage returns the custom page of the site (or the default site)
+func sitePage(r *http.Request, code int) []byte {
+	site, ok := config.SiteOf(r)
+	fn := site.Errors
+	if !ok {
+		fn = config.Sites().Errors["default"]
+	}
+	if fn == nil {
+		return nil
+	}
+	return fn(code)
+}
+
+// WantsJSON reports if Accept ranks application/json above text/html,
+// shared by error pages and dir listings
+func WantsJSON(r *http.Request) bool {
+	jsonQ, htmlQ := 0.0, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediatype, params, e := mime.ParseMediaType(strings.TrimSpace(part))
+		if e != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, e = strconv.ParseFloat(v, 64); e != nil {
+				continue
+			}
+		}
+		switch {
+		case mediatype == "application/json" || strings.HasSuffix(mediatype, "+json"):
+			jsonQ = max(jsonQ, q)
+		case mediatype == "text/html":
+			htmlQ = max(htmlQ, q)
+		}
+	}
+	return jsonQ > htmlQ
+}
+
+// LimitPage replaces the ratelimiter's plain-text 429 with Error
+func LimitPage(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&limitWriter{ResponseWriter: w, r: r}, r)
+	})
+}
+
+type limitWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	replaced bool
+}
+
+func (l *limitWriter) WriteHeader(code int) {
+	if code == http.StatusTooManyRequests && strings.HasPrefix(l.Header().Get("Content-Type"), "text/plain") {
+		l.replaced = true
+		Error(l.ResponseWriter, l.r, code)
+		return
+	}
+	l.ResponseWriter.WriteHeader(code)
+}
+
+func (l *limitWriter) Write(b []byte) (int, error) {
+	if l.replaced {
+		// Drop the plain-text body
+		return len(b), nil
+	}
+	return l.ResponseWriter.Write(b)
+}
+
+func (l *limitWriter) Flush() {
+	if f, ok := l.ResponseWriter.(http.Flusher); ok && !l.replaced {
+		f.Flush()
+	}
+}
+
+func (l *limitWriter) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
+}
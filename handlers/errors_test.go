@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/mpdroog/hfast/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	old := config.Sites()
+	sites := config.NewVhosts()
+	sites.Overrides["example.com"] = config.Override{}
+	sites.Errors["example.com"] = func(code int) []byte {
+		if code == http.StatusNotFound {
+			return []byte("<h1>custom 404</h1>")
+		}
+		return nil
+	}
+	config.SetSites(sites)
+	defer config.SetSites(old)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/missing", nil)
+	w.Header().Set("Etag", `"stale"`)
+	Error(w, r, http.StatusNotFound)
+	if w.Code != http.StatusNotFound || w.Body.String() != "<h1>custom 404</h1>" {
+		t.Errorf("expect custom 404, got=%d %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Cache-Control") != "no-store" || w.Header().Get("Etag") != "" {
+		t.Errorf("unexpected headers %v", w.Header())
+	}
+
+	// No custom page, built-in
+	w = httptest.NewRecorder()
+	Error(w, r, http.StatusServiceUnavailable)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "503 Service Unavailable") {
+		t.Errorf("expect built-in 503, got=%d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.Header.Set("Accept", "application/json, text/plain, */*")
+	Error(w, r, http.StatusNotFound)
+	var body struct {
+		Status int
+		Error  string
+	}
+	if e := json.Unmarshal(w.Body.Bytes(), &body); e != nil || body.Status != 404 || body.Error != "Not Found" {
+		t.Errorf("expect JSON, got=%s", w.Body.String())
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	tests := map[string]bool{
+		"": false,
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8": false,
+		"application/json":                  true,
+		"application/problem+json":          true,
+		"text/html;q=0.5, application/json": true,
+		"application/json;q=0.5, text/html": false,
+	}
+	for accept, expect := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", accept)
+		if WantsJSON(r) != expect {
+			t.Errorf("WantsJSON(%s) expect %t", accept, expect)
+		}
+	}
+}
+
+func TestLimitPage(t *testing.T) {
+	limited := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	})
+	w := httptest.NewRecorder()
+	LimitPage(limited).ServeHTTP(w, httptest.NewRequest("GET", "/action/", nil))
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "<h1>429 Too Many Requests</h1>") {
+		t.Errorf("expect 429 page, got=%d %s", w.Code, w.Body.String())
+	}
+
+	// Application responses pass untouched
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"retry":5}`))
+	})
+	w = httptest.NewRecorder()
+	LimitPage(app).ServeHTTP(w, httptest.NewRequest("GET", "/action/", nil))
+	if w.Body.String() != `{"retry":5}` {
+		t.Errorf("expect app body, got=%s", w.Body.String())
+	}
+}
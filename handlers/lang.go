@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"github.com/mpdroog/hfast/config"
+	"golang.org/x/text/language"
+	"net/http"
+)
+
+// LangCookie overrides Accept-Language when set to one of Lang
+const LangCookie = "lang"
+
+// LangRedirect redirects the homepage to /<lang>/ for sites with Lang in
+// override.toml, negotiated on LangCookie and Accept-Language with
+// a fallback to the first configured language
+func LangRedirect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" || (r.Method != "GET" && r.Method != "HEAD") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		site, _ := config.SiteOf(r)
+		if site.Lang == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		m, langs := site.Lang, site.Override.Lang
+
+		cookie := ""
+		if c, e := r.Cookie(LangCookie); e == nil {
+			cookie = c.Value
+		}
+		// No match returns index 0 (the first configured language)
+		_, idx := language.MatchStrings(m, cookie, r.Header.Get("Accept-Language"))
+
+		target := "/" + langs[idx] + "/"
+		if q := r.URL.RawQuery; q != "" {
+			target += "?" + q
+		}
+		w.Header().Add("Vary", "Accept-Language")
+		w.Header().Add("Vary", "Cookie")
+		w.Header().Set("Cache-Control", "no-cache,no-store,must-revalidate")
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+}
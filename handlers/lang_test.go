@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"github.com/mpdroog/hfast/config"
+	"golang.org/x/text/language"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLangRedirect(t *testing.T) {
+	sites := config.NewVhosts()
+	sites.Overrides["example.com"] = config.Override{Lang: []string{"en", "nl"}}
+	sites.Langs["example.com"] = language.NewMatcher([]language.Tag{language.English, language.Dutch})
+	config.SetSites(sites)
+	defer config.SetSites(config.NewVhosts())
+
+	h := LangRedirect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("static"))
+	}))
+
+	tests := []struct {
+		path, accept, cookie, expect string
+	}{
+		{"/", "nl-NL,nl;q=0.9,en;q=0.8", "", "/nl/"},
+		{"/", "de-DE", "", "/en/"},
+		{"/", "", "", "/en/"},
+		{"/", "en", "nl", "/nl/"},
+		{"/?utm=1", "nl", "", "/nl/?utm=1"},
+		{"/nl/", "en", "", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "https://example.com"+test.path, nil)
+		r.Header.Set("Accept-Language", test.accept)
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: LangCookie, Value: test.cookie})
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if test.expect == "" {
+			if w.Code != 200 {
+				t.Errorf("%s expected static, got code=%d", test.path, w.Code)
+			}
+			continue
+		}
+		if w.Code != http.StatusFound || w.Header().Get("Location") != test.expect {
+			t.Errorf("%s accept=%s cookie=%s expect=%s got code=%d location=%s", test.path, test.accept, test.cookie, test.expect, w.Code, w.Header().Get("Location"))
+		}
+		if w.Header().Values("Vary")[0] != "Accept-Language" {
+			t.Errorf("%s missing Vary", test.path)
+		}
+	}
+}
@@ -35,17 +35,18 @@ func (rh *RedirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	host, iswww := normalizeHost(r.Host)
-	if _, ok := config.Muxs[host]; !ok {
+	sites := config.Sites()
+	if _, ok := sites.Muxs[host]; !ok {
 		if !strings.HasPrefix(host, "127.0.0.1") {
 			logger.Printf("Unmatched host: %s", host)
 		}
 
-		if mux, ok := config.Muxs["default"]; ok {
+		if mux, ok := sites.Muxs["default"]; ok {
 			mux.ServeHTTP(w, r)
 			return
 		}
 
-		http.Error(w, "ERR: No such site.", http.StatusBadRequest)
+		Error(w, r, http.StatusBadRequest)
 		return
 	}
 
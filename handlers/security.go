@@ -42,7 +42,7 @@ func sec(domains []string, appMode string) map[string]string {
 	responseHeader[permissionsPolicyHeader] = permissionsPolicyValue
 	responseHeader[referrerPolicyHeader] = referrerPolicyValue
 	responseHeader[altSvcHeader] = altSvcValue
-	if appMode == "" {
+	if appMode == "" || appMode == "spa" {
 		responseHeader[cspHeader] = fmt.Sprintf("default-src 'self' %s", strings.Join(domains, " "))
 	}
 	return responseHeader
@@ -50,9 +50,10 @@ func sec(domains []string, appMode string) map[string]string {
 
 func SecureWrapper(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		override, ok := config.Overrides[r.Host]
+		site, ok := config.SiteOf(r)
+		override := site.Override
 		if !ok {
-			override = config.Overrides["default"]
+			override = config.Sites().Overrides["default"]
 			// panic(fmt.Sprintf("DevErr: Host(%s) not configured", host))
 		}
 
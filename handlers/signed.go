@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sign returns the hex HMAC-SHA256 of upath (unescaped, as in
+// r.URL.Path) valid until exp (unix seconds), the signed message
+// is "<upath>?exp=<exp>"
+func Sign(key, upath string, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(upath + "?exp=" + strconv.FormatInt(exp, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignURL returns upath with the exp and sig query parameters
+func SignURL(key, upath string, exp time.Time) string {
+	u := url.URL{Path: upath}
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(exp.Unix(), 10))
+	q.Set("sig", Sign(key, upath, exp.Unix()))
+	return u.EscapedPath() + "?" + q.Encode()
+}
+
+// Signed only serves paths below prefixes with a valid, unexpired
+// ?exp=<unix>&sig=<hex hmac> (see Sign)
+func Signed(h http.Handler, prefixes []string, key string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protected := false
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				protected = true
+				break
+			}
+		}
+		if !protected {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		q := r.URL.Query()
+		exp, e := strconv.ParseInt(q.Get("exp"), 10, 64)
+		if e != nil || exp < time.Now().Unix() {
+			Error(w, r, http.StatusForbidden)
+			return
+		}
+		if !hmac.Equal([]byte(q.Get("sig")), []byte(Sign(key, r.URL.Path, exp))) {
+			Error(w, r, http.StatusForbidden)
+			return
+		}
+
+		// Not for shared caches
+		w.Header().Set("Cache-Control", "private")
+		h.ServeHTTP(w, r)
+	})
+}
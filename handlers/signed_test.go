@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigned(t *testing.T) {
+	const key = "secret"
+	h := Signed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("file"))
+	}), []string{"/invoices/"}, key)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	if w := get("/public.txt"); w.Body.String() != "file" {
+		t.Errorf("unprotected expect file, got=%d", w.Code)
+	}
+
+	exp := time.Now().Add(time.Hour)
+	link := SignURL(key, "/invoices/2024 #1.pdf", exp)
+	if !strings.HasPrefix(link, "/invoices/2024%20%231.pdf?exp=") {
+		t.Errorf("unexpected link %s", link)
+	}
+	if w := get(link); w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "private" {
+		t.Errorf("signed expect 200, got=%d %s", w.Code, link)
+	}
+
+	sig := Sign(key, "/invoices/1.pdf", exp.Unix())
+	tests := []string{
+		"/invoices/1.pdf",
+		"/invoices/1.pdf?exp=" + strconv.FormatInt(exp.Unix(), 10),
+		"/invoices/2.pdf?exp=" + strconv.FormatInt(exp.Unix(), 10) + "&sig=" + sig,
+		"/invoices/1.pdf?exp=" + strconv.FormatInt(exp.Unix()+1, 10) + "&sig=" + sig,
+		SignURL(key, "/invoices/1.pdf", time.Now().Add(-time.Second)),
+		SignURL("other", "/invoices/1.pdf", exp),
+	}
+	for _, url := range tests {
+		if w := get(url); w.Code != http.StatusForbidden {
+			t.Errorf("%s expect 403, got=%d", url, w.Code)
+		}
+	}
+}
@@ -17,22 +17,27 @@ func Vhost() http.HandlerFunc {
 			return
 		}
 
-		m, ok := config.Muxs[r.Host]
+		// Resolve once so a reload mid-request keeps the old handler
+		sites := config.Sites()
+		m, ok := sites.Muxs[r.Host]
 		if !ok {
 			logger.Printf("Unmatched host: %s", r.Host)
-			w.Write([]byte("ERR: No such site."))
+			Error(w, r, http.StatusNotFound)
 			return
 		}
 
-		cfg, ok := config.Overrides[r.Host]
+		site, ok := sites.Site(r.Host)
 		if !ok {
 			panic("Host set in muxs but not on overrides?")
 		}
+		site.Domain = host
 
-		// Extend with some vars for use in hfast/queue
-		r.Header.Set("X-Domain", host)
-		r.Header.Set("X-Secretkey", cfg.SecretKey)
+		// Never trust these from clients, backends used to read them
+		r.Header.Del("X-Domain")
+		r.Header.Del("X-Secretkey")
 
+		// Site for use in hfast/queue
+		r = r.WithContext(config.WithSite(r.Context(), site))
 		m.ServeHTTP(w, r)
 		// Strip off sensitive info
 		w.Header().Del("X-Powered-By")
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"github.com/mpdroog/hfast/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVhostSite(t *testing.T) {
+	var site config.Site
+	var headers http.Header
+	sites := config.NewVhosts()
+	sites.Muxs["example.com"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A reload mid-request isn't noticed
+		config.SetSites(config.NewVhosts())
+		site, _ = config.SiteOf(r)
+		headers = r.Header
+	})
+	sites.Overrides["example.com"] = config.Override{SecretKey: "secret"}
+	config.SetSites(sites)
+	defer config.SetSites(config.NewVhosts())
+
+	r := httptest.NewRequest("GET", "https://example.com/", nil)
+	r.Header.Set("X-Domain", "other.com")
+	r.Header.Set("X-Secretkey", "spoofed")
+	Vhost().ServeHTTP(httptest.NewRecorder(), r)
+
+	if site.Domain != "example.com" || site.Override.SecretKey != "secret" {
+		t.Errorf("unexpected site %+v", site)
+	}
+	if headers.Get("X-Domain") != "" || headers.Get("X-Secretkey") != "" {
+		t.Errorf("client headers not stripped %v", headers)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"expvar"
+	"github.com/mpdroog/hfast/config"
+	"github.com/mpdroog/hfast/logger"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// Files up to this size are kept in memory by the hot cache
+const hotMaxFile = 256 * 1024
+
+// Budget of a cached Exists answer (name and bookkeeping)
+const hotExistsCost = 128
+
+func init() {
+	expvar.Publish("hotcache", expvar.Func(hotStats))
+}
+
+// hotRoot is a watched pub/ dir, shared by reloads like fpmBackend
+type hotRoot struct {
+	dir     Dir
+	watched atomic.Bool
+	gen     atomic.Uint64 // bumped on every change so a read racing a change isn't cached
+
+	mu      sync.Mutex // (re)watching
+	path    string     // watched dir, dir with symlinks resolved
+	dropped bool       // unwatched for good
+	used    uint64     // last loadSites using it (hotRootsMu)
+}
+
+// current reports if root is watched at the dir it resolves to now
+func (root *hotRoot) current() bool {
+	path, e := filepath.EvalSymlinks(string(root.dir))
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	return e == nil && root.watched.Load() && path == root.path
+}
+
+var (
+	hotRootsMu sync.Mutex
+	hotRoots   = make(map[Dir]*hotRoot)
+)
+
+// hotKey is either the Exists answer or the content of name
+type hotKey struct {
+	root   *hotRoot
+	name   string
+	exists bool
+}
+
+type hotEntry struct {
+	key     hotKey
+	found   bool // Exists answer
+	content []byte
+	info    os.FileInfo
+	ctype   string
+	cost    int64
+}
+
+// hotCache is an LRU of small files and Exists answers bounded by
+// config.Server.HotCache, entries are dropped by the inotify watcher
+type hotCache struct {
+	mu      sync.Mutex
+	lru     *list.List // front=most recently used
+	entries map[hotKey]*list.Element
+	bytes   int64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+var hot = &hotCache{
+	lru:     list.New(),
+	entries: make(map[hotKey]*list.Element),
+}
+
+func (c *hotCache) get(k hotKey) (*hotEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[k]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*hotEntry), true
+}
+
+// set stores entry unless root changed since gen was read
+func (c *hotCache) set(entry *hotEntry, gen uint64) {
+	max := int64(config.Server.HotCache) * 1024 * 1024
+	if entry.cost > max {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry.key.root.gen.Load() != gen {
+		return
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	for c.bytes+entry.cost > max {
+		c.remove(c.lru.Back())
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.bytes += entry.cost
+}
+
+func (c *hotCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*hotEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.cost
+}
+
+// invalidate drops name (content and Exists answer) of root
+func (c *hotCache) invalidate(root *hotRoot, name string) {
+	root.gen.Add(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, exists := range []bool{true, false} {
+		if elem, ok := c.entries[hotKey{root: root, name: name, exists: exists}]; ok {
+			c.remove(elem)
+		}
+	}
+}
+
+// purge drops all entries of root, nil for all roots
+func (c *hotCache) purge(root *hotRoot) {
+	if root != nil {
+		root.gen.Add(1)
+	} else {
+		hotRootsMu.Lock()
+		for _, r := range hotRoots {
+			r.gen.Add(1)
+		}
+		hotRootsMu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if root == nil || elem.Value.(*hotEntry).key.root == root {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// pruneHotRoots unwatches the roots not used by generation gen
+func pruneHotRoots(gen uint64) {
+	hotRootsMu.Lock()
+	defer hotRootsMu.Unlock()
+	for dir, root := range hotRoots {
+		if root.used != gen {
+			delete(hotRoots, dir)
+			unwatchRoot(root)
+			root.watched.Store(false)
+			hot.purge(root)
+		}
+	}
+}
+
+// hotFS caches small files and Exists answers of a watched Dir
+type hotFS struct {
+	root *hotRoot
+}
+
+// HotFS returns dir with the hot file cache in front, or dir itself
+// when the cache is off or dir can't be watched. Called on every
+// (re)load so a root that lost its watches is watched again
+func HotFS(dir Dir) FileSystem {
+	if config.Server.HotCache <= 0 {
+		return dir
+	}
+
+	hotRootsMu.Lock()
+	defer hotRootsMu.Unlock()
+	root, ok := hotRoots[dir]
+	if !ok {
+		root = &hotRoot{dir: dir}
+		if e := watchRoot(root); e != nil {
+			unwatchRoot(root)
+			logger.Printf("hotcache(%s) disabled e=%s", string(dir), e.Error())
+			return dir
+		}
+		hotRoots[dir] = root
+	} else if !root.current() {
+		// Swapped symlink or watches lost
+		if e := watchRoot(root); e != nil {
+			logger.Printf("hotcache(%s) disabled e=%s", string(dir), e.Error())
+			return dir
+		}
+	}
+	root.used = loadGen.Load()
+	return &hotFS{root: root}
+}
+
+// String identifies the root, same as Dir so the etag cache is shared
+func (h *hotFS) String() string {
+	return h.root.dir.String()
+}
+
+func (h *hotFS) Exists(name string) (bool, error) {
+	if !h.root.watched.Load() {
+		return h.root.dir.Exists(name)
+	}
+	k := hotKey{root: h.root, name: name, exists: true}
+	if entry, ok := hot.get(k); ok {
+		return entry.found, nil
+	}
+
+	gen := h.root.gen.Load()
+	ok, e := h.root.dir.Exists(name)
+	if e == nil || !ok {
+		hot.set(&hotEntry{key: k, found: ok, cost: hotExistsCost + int64(len(name))}, gen)
+	}
+	return ok, e
+}
+
+func (h *hotFS) Open(name string) (File, error) {
+	if !h.root.watched.Load() {
+		return h.root.dir.Open(name)
+	}
+	k := hotKey{root: h.root, name: name}
+	if entry, ok := hot.get(k); ok {
+		return &memFile{Reader: bytes.NewReader(entry.content), info: entry.info, ctype: entry.ctype}, nil
+	}
+
+	gen := h.root.gen.Load()
+	f, e := h.root.dir.Open(name)
+	if e != nil {
+		return nil, e
+	}
+	d, e := f.Stat()
+	if e != nil || !d.Mode().IsRegular() || d.Size() > hotMaxFile {
+		return f, nil
+	}
+	defer f.Close()
+
+	content, e := io.ReadAll(io.LimitReader(f, hotMaxFile+1))
+	if e != nil {
+		return nil, e
+	}
+	if int64(len(content)) != d.Size() {
+		// Changed while reading, don't cache
+		return &memFile{Reader: bytes.NewReader(content), info: d}, nil
+	}
+
+	entry := &hotEntry{key: k, content: content, info: d, ctype: hotContentType(name, content)}
+	entry.cost = int64(len(content)) + hotExistsCost + int64(len(name))
+	hot.set(entry, gen)
+	return &memFile{Reader: bytes.NewReader(content), info: d, ctype: entry.ctype}, nil
+}
+
+// hotContentType is the Content-Type serveContent would derive for
+// name requested as-is, negotiated variants are typed by serveContent
+func hotContentType(name string, content []byte) string {
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype
+	}
+	return http.DetectContentType(content[:min(len(content), sniffLen)])
+}
+
+// memFile is a cached file
+type memFile struct {
+	*bytes.Reader
+	info  os.FileInfo
+	ctype string
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (f *memFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// ContentType returns the cached Content-Type ("" when unknown)
+func (f *memFile) ContentType() string {
+	return f.ctype
+}
+
+// HotCacheStats serves hotStats as JSON
+func HotCacheStats() http.Handler {
+	return expvarHandler("hotcache")
+}
+
+// hotStat is the state of the hot file cache
+type hotStat struct {
+	Hits    int64
+	Misses  int64
+	Entries int
+	Bytes   int64
+	Roots   int
+}
+
+// hotStats returns the hot file cache counters (expvar "hotcache")
+func hotStats() interface{} {
+	hotRootsMu.Lock()
+	roots := len(hotRoots)
+	hotRootsMu.Unlock()
+
+	hot.mu.Lock()
+	defer hot.mu.Unlock()
+	return hotStat{
+		Hits:    hot.hits.Load(),
+		Misses:  hot.misses.Load(),
+		Entries: hot.lru.Len(),
+		Bytes:   hot.bytes,
+		Roots:   roots,
+	}
+}
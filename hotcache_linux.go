@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/mpdroog/hfast/logger"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const hotWatchMask = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_DELETE_SELF |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_MOVE_SELF
+
+// hotWatch is a watched dir, rel is its path below the root ("" for
+// pub/ itself). A parent watch is the dir holding pub/, rel is then
+// the name of pub/ in it so a swapped (renamed, recreated or
+// re-linked) pub/ is noticed
+type hotWatch struct {
+	root   *hotRoot
+	rel    string
+	parent bool
+}
+
+// One inotify instance for all roots, a wd can be shared by roots
+// (i.e. two Fallback dirs in the same parent)
+var watcher struct {
+	once    sync.Once
+	fd      int
+	err     error
+	mu      sync.Mutex
+	watches map[int32][]hotWatch
+}
+
+// watchRoot (re)adds inotify watches on root and every dir below it
+// (inotify is not recursive), dot-dirs are skipped as serveFile
+// never serves them. A symlinked root is watched at its target.
+// On error the parent watch is kept so a recreated root is picked up
+func watchRoot(root *hotRoot) error {
+	watcher.once.Do(func() {
+		watcher.fd, watcher.err = syscall.InotifyInit1(syscall.IN_CLOEXEC)
+		if watcher.err == nil {
+			watcher.watches = make(map[int32][]hotWatch)
+			go watchLoop()
+		}
+	})
+	if watcher.err != nil {
+		return watcher.err
+	}
+
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.dropped {
+		return fmt.Errorf("dropped")
+	}
+	root.watched.Store(false)
+	hot.purge(root)
+	unwatch(root, false)
+
+	dir := string(root.dir)
+	if e := addWatch(filepath.Dir(dir), hotWatch{root: root, rel: filepath.Base(dir), parent: true}); e != nil {
+		return e
+	}
+	path, e := filepath.EvalSymlinks(dir)
+	if e != nil {
+		return e
+	}
+	root.path = path
+	if e := watchTree(root, ""); e != nil {
+		unwatch(root, true)
+		return e
+	}
+	// Drop what was read while the watches were added
+	hot.purge(root)
+	root.watched.Store(true)
+	return nil
+}
+
+// unwatchRoot removes all watches of root for good
+func unwatchRoot(root *hotRoot) {
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	root.dropped = true
+	if watcher.err != nil || watcher.watches == nil {
+		return
+	}
+	unwatch(root, false)
+}
+
+// watchTree adds the dirs below rel, root.mu is held
+func watchTree(root *hotRoot, rel string) error {
+	base := root.path
+	return filepath.WalkDir(filepath.Join(base, filepath.FromSlash(rel)), func(p string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		sub := filepath.ToSlash(strings.TrimPrefix(p, base))
+		if strings.Contains(sub, "/.") {
+			return filepath.SkipDir
+		}
+		return addWatch(p, hotWatch{root: root, rel: sub})
+	})
+}
+
+func addWatch(p string, w hotWatch) error {
+	wd, e := syscall.InotifyAddWatch(watcher.fd, p, hotWatchMask)
+	if e != nil {
+		return e
+	}
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	for _, cur := range watcher.watches[int32(wd)] {
+		if cur == w {
+			return nil
+		}
+	}
+	watcher.watches[int32(wd)] = append(watcher.watches[int32(wd)], w)
+	return nil
+}
+
+// unwatch drops the watches of root (but the parent one with
+// keepParent), root.mu is held
+func unwatch(root *hotRoot, keepParent bool) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	for wd, ws := range watcher.watches {
+		kept := []hotWatch{}
+		for _, w := range ws {
+			if w.root != root || (keepParent && w.parent) {
+				kept = append(kept, w)
+			}
+		}
+		if len(kept) == len(ws) {
+			continue
+		}
+		if len(kept) > 0 {
+			watcher.watches[wd] = kept
+			continue
+		}
+		delete(watcher.watches, wd)
+		// Fails when the kernel already dropped it (dir removed)
+		syscall.InotifyRmWatch(watcher.fd, uint32(wd))
+	}
+}
+
+// watchLoop invalidates the hot cache on changes below the roots
+func watchLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, e := syscall.Read(watcher.fd, buf)
+		if e == syscall.EINTR {
+			continue
+		}
+		if e != nil || n <= 0 {
+			// Without events the cache can't be trusted
+			logger.Printf("hotcache inotify stopped e=%v", e)
+			hotRootsMu.Lock()
+			for _, root := range hotRoots {
+				root.watched.Store(false)
+			}
+			hotRootsMu.Unlock()
+			hot.purge(nil)
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[off:]))
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			size := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			name := strings.TrimRight(string(buf[off+syscall.SizeofInotifyEvent:off+syscall.SizeofInotifyEvent+size]), "\x00")
+			off += syscall.SizeofInotifyEvent + size
+			watchEvent(wd, mask, name)
+		}
+	}
+}
+
+func watchEvent(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		logger.Printf("hotcache inotify queue overflow, purging")
+		hot.purge(nil)
+		return
+	}
+
+	watcher.mu.Lock()
+	ws := watcher.watches[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(watcher.watches, wd)
+	}
+	watcher.mu.Unlock()
+
+	for _, w := range ws {
+		switch {
+		case w.parent:
+			if name == w.rel && mask&(syscall.IN_CREATE|syscall.IN_DELETE|syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO) != 0 {
+				rewatch(w.root)
+			}
+		case w.rel == "" && mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0:
+			// pub/ itself is gone or renamed away
+			rewatch(w.root)
+		case mask&syscall.IN_ISDIR != 0 || mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0:
+			// Whole tree changed (dir renamed/removed/added)
+			hot.purge(w.root)
+			if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && !strings.HasPrefix(name, ".") {
+				w.root.mu.Lock()
+				e := watchTree(w.root, w.rel+"/"+name)
+				w.root.mu.Unlock()
+				if e != nil {
+					// Changes below it would go unnoticed
+					logger.Printf("hotcache(%s) disabled e=%s", string(w.root.dir), e.Error())
+					w.root.watched.Store(false)
+					hot.purge(w.root)
+				}
+			}
+		default:
+			hot.invalidate(w.root, w.rel+"/"+name)
+		}
+	}
+}
+
+// rewatch watches a swapped pub/ again, the cache of root stays off
+// until it exists again
+func rewatch(root *hotRoot) {
+	if e := watchRoot(root); e != nil {
+		logger.Printf("hotcache(%s) paused e=%s", string(root.dir), e.Error())
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"github.com/mpdroog/hfast/config"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readHot(t *testing.T, fs FileSystem, name string) string {
+	f, e := fs.Open(name)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer f.Close()
+	b, e := io.ReadAll(f)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return string(b)
+}
+
+// eventually polls fn as inotify events arrive asynchronously
+func eventually(t *testing.T, fn func() bool) {
+	for i := 0; i < 100; i++ {
+		if fn() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timeout waiting for invalidation")
+}
+
+func TestHotCache(t *testing.T) {
+	dir := t.TempDir()
+	if e := os.WriteFile(filepath.Join(dir, "app.css"), []byte("v1"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	old := config.Server.HotCache
+	config.Server.HotCache = 1
+	defer func() { config.Server.HotCache = old }()
+
+	fs := HotFS(Dir(dir))
+	if _, ok := fs.(*hotFS); !ok {
+		t.Fatalf("expected hotFS, got=%T", fs)
+	}
+
+	hits := hot.hits.Load()
+	if s := readHot(t, fs, "/app.css"); s != "v1" {
+		t.Fatalf("expected v1, got=%s", s)
+	}
+	f, e := fs.Open("/app.css")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if f.(*memFile).ContentType() != "text/css; charset=utf-8" {
+		t.Errorf("unexpected Content-Type=%s", f.(*memFile).ContentType())
+	}
+	f.Close()
+	if hot.hits.Load() != hits+1 {
+		t.Errorf("expected cache hit")
+	}
+
+	// Modify
+	if e := os.WriteFile(filepath.Join(dir, "app.css"), []byte("v2"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return readHot(t, fs, "/app.css") == "v2" })
+
+	// Negative Exists answer dropped on create, also in new subdirs
+	if ok, _ := fs.Exists("/sub/app.css.br"); ok {
+		t.Fatal("unexpected exists")
+	}
+	if e := os.Mkdir(filepath.Join(dir, "sub"), 0755); e != nil {
+		t.Fatal(e)
+	}
+	if e := os.WriteFile(filepath.Join(dir, "sub", "app.css.br"), []byte("br"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool {
+		ok, _ := fs.Exists("/sub/app.css.br")
+		return ok
+	})
+	readHot(t, fs, "/sub/app.css.br")
+	if e := os.WriteFile(filepath.Join(dir, "sub", "app.css.br"), []byte("br2"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return readHot(t, fs, "/sub/app.css.br") == "br2" })
+
+	// Delete
+	if e := os.Remove(filepath.Join(dir, "app.css")); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool {
+		_, e := fs.Open("/app.css")
+		return os.IsNotExist(e)
+	})
+}
+
+func TestHotCacheContentType(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"archive.tar.gz": "tar", "app.js": "js", "app.js.gz": "gz"}
+	for name, content := range files {
+		if e := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+	old := config.Server.HotCache
+	config.Server.HotCache = 1
+	defer func() { config.Server.HotCache = old }()
+
+	h := FileServer(HotFS(Dir(dir)))
+	gzip := map[string]string{"Accept-Encoding": "gzip"}
+	// Second round is served from the hot cache
+	for i := 0; i < 2; i++ {
+		if w := archiveGet(t, h, "/archive.tar.gz", gzip); w.Header().Get("Content-Type") != "application/gzip" || w.Header().Get("Content-Encoding") != "" {
+			t.Errorf("direct .tar.gz expect application/gzip, got=%v", w.Header())
+		}
+		if w := archiveGet(t, h, "/app.js.gz", nil); w.Header().Get("Content-Type") != "application/gzip" {
+			t.Errorf("direct .js.gz expect application/gzip, got=%v", w.Header())
+		}
+		w := archiveGet(t, h, "/app.js", gzip)
+		if w.Header().Get("Content-Encoding") != "gzip" || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/javascript") {
+			t.Errorf("variant expect javascript, got=%v", w.Header())
+		}
+	}
+}
+
+func TestHotCacheSwap(t *testing.T) {
+	base := t.TempDir()
+	for _, release := range []string{"r1", "r2"} {
+		if e := os.Mkdir(filepath.Join(base, release), 0755); e != nil {
+			t.Fatal(e)
+		}
+		if e := os.WriteFile(filepath.Join(base, release, "app.css"), []byte(release), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+	pub := filepath.Join(base, "pub")
+	if e := os.Symlink("r1", pub); e != nil {
+		t.Fatal(e)
+	}
+	old := config.Server.HotCache
+	config.Server.HotCache = 1
+	defer func() { config.Server.HotCache = old }()
+
+	fs := HotFS(Dir(pub))
+	if _, ok := fs.(*hotFS); !ok {
+		t.Fatalf("expected hotFS, got=%T", fs)
+	}
+	readHot(t, fs, "/app.css")
+
+	// Symlinked pub/ is watched at its target
+	if e := os.WriteFile(filepath.Join(base, "r1", "app.css"), []byte("r1b"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return readHot(t, fs, "/app.css") == "r1b" })
+
+	// Re-linked
+	if e := os.Symlink("r2", pub+".tmp"); e != nil {
+		t.Fatal(e)
+	}
+	if e := os.Rename(pub+".tmp", pub); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return readHot(t, fs, "/app.css") == "r2" })
+	if e := os.WriteFile(filepath.Join(base, "r2", "app.css"), []byte("r2b"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return readHot(t, fs, "/app.css") == "r2b" })
+
+	// Removed and recreated as dir
+	if e := os.Remove(pub); e != nil {
+		t.Fatal(e)
+	}
+	if e := os.Mkdir(pub, 0755); e != nil {
+		t.Fatal(e)
+	}
+	if e := os.WriteFile(filepath.Join(pub, "app.css"), []byte("dir"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return readHot(t, fs, "/app.css") == "dir" })
+	eventually(t, func() bool { return fs.(*hotFS).root.watched.Load() })
+	readHot(t, fs, "/app.css")
+	if e := os.WriteFile(filepath.Join(pub, "app.css"), []byte("dir2"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	eventually(t, func() bool { return readHot(t, fs, "/app.css") == "dir2" })
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+// watchRoot needs inotify, elsewhere the hot cache stays off
+func watchRoot(root *hotRoot) error {
+	return fmt.Errorf("hot file cache needs inotify (linux)")
+}
+
+func unwatchRoot(root *hotRoot) {}
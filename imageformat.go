@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// imageFormat is a modern image variant stored next to the original
+type imageFormat struct {
+	mime string
+	ext  string
+}
+
+// Variants in order of preference when the client gives them the
+// same q-value
+var imageFormats = []imageFormat{
+	{"image/avif", ".avif"},
+	{"image/webp", ".webp"},
+}
+
+// Originals that can have an .avif/.webp variant
+var imageExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+}
+
+// imageVariant returns the .avif/.webp variant of image name the client
+// accepts (photo.jpg.avif or photo.avif), or name itself. Only formats
+// explicitly listed in Accept count, */* is sent by clients that can't
+// decode them.
+func imageVariant(w http.ResponseWriter, r *http.Request, fs FileSystem, name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if !imageExts[ext] {
+		return name
+	}
+
+	accept := parseQList(r.Header.Get("Accept"))
+	bestQ := 0.0
+	best := name
+	bestMime := ""
+	varies := false
+	for _, f := range imageFormats {
+		q := accept[f.mime]
+		if q <= bestQ && varies {
+			continue
+		}
+		variant := imageVariantFile(fs, name, f.ext)
+		if variant == "" {
+			continue
+		}
+		varies = true
+		if q > bestQ {
+			best, bestQ, bestMime = variant, q, f.mime
+		}
+	}
+	if varies {
+		// Response depends on Accept, also for the original
+		w.Header().Add("Vary", "Accept")
+	}
+	if bestMime != "" {
+		w.Header().Set("Content-Type", bestMime)
+	}
+	return best
+}
+
+// imageVariantFile returns the existing variant of name with ext, "" for none
+func imageVariantFile(fs FileSystem, name, ext string) string {
+	for _, variant := range []string{name + ext, strings.TrimSuffix(name, path.Ext(name)) + ext} {
+		if ok, _ := fs.Exists(variant); ok {
+			return variant
+		}
+	}
+	return ""
+}
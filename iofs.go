@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// Non-seekable files (i.e. deflated zip entries) are read into
+// memory up to this size, bigger ones can't be served
+const ioMaxBuffer = 32 * 1024 * 1024
+
+// IOFS adapts any fs.FS to FileSystem
+type IOFS struct {
+	FS   fs.FS
+	Name string // identifies the root (i.e. for the etag cache)
+}
+
+// ioName maps a '/'-separated FileSystem name onto a valid fs.FS path
+func ioName(name string) (string, error) {
+	if strings.Contains(name, "\\") {
+		return "", errors.New("http: invalid character in file path: " + name)
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		name = "."
+	}
+	return name, nil
+}
+
+func (i IOFS) String() string {
+	return i.Name
+}
+
+func (i IOFS) Open(name string) (File, error) {
+	name, e := ioName(name)
+	if e != nil {
+		return nil, e
+	}
+	f, e := i.FS.Open(name)
+	if e != nil {
+		return nil, e
+	}
+	d, e := f.Stat()
+	if e != nil {
+		f.Close()
+		return nil, e
+	}
+
+	if seeker, ok := f.(io.ReadSeeker); ok || d.IsDir() {
+		return &ioFile{File: f, seeker: seeker}, nil
+	}
+
+	// Not seekable, buffer so ranges/sniffing work
+	if d.Size() > ioMaxBuffer {
+		f.Close()
+		return nil, fmt.Errorf("%s not seekable and above %d bytes", name, ioMaxBuffer)
+	}
+	content, e := io.ReadAll(f)
+	f.Close()
+	if e != nil {
+		return nil, e
+	}
+	return &memFile{Reader: bytes.NewReader(content), info: d}, nil
+}
+
+func (i IOFS) Exists(name string) (bool, error) {
+	name, e := ioName(name)
+	if e != nil {
+		return false, e
+	}
+	_, e = fs.Stat(i.FS, name)
+	if errors.Is(e, fs.ErrNotExist) {
+		return false, e
+	}
+	return true, e
+}
+
+// ioFile adds Seek and Readdir to an fs.File
+type ioFile struct {
+	fs.File
+	seeker io.ReadSeeker
+}
+
+func (f *ioFile) Seek(offset int64, whence int) (int64, error) {
+	if f.seeker == nil {
+		return 0, errors.New("seek on directory")
+	}
+	return f.seeker.Seek(offset, whence)
+}
+
+func (f *ioFile) Readdir(count int) ([]os.FileInfo, error) {
+	dir, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, errors.New("not a directory")
+	}
+	entries, e := dir.ReadDir(count)
+	out := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, ie := entry.Info()
+		if ie != nil {
+			return out, ie
+		}
+		out = append(out, info)
+	}
+	return out, e
+}
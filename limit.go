@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mpdroog/ratelimit"
+	"github.com/mpdroog/ratelimit/memory"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limiters per "<key> <rate>", kept across reloads so a SIGHUP doesn't
+// reset the counters
+var (
+	limitMu  sync.Mutex
+	limiters = make(map[string]*limitEntry)
+)
+
+type limitEntry struct {
+	h   http.Handler
+	gen uint64 // last loadSites using it
+}
+
+type limitNextKey struct{}
+
+// limitNext serves the handler limiter put on the context, the
+// ratelimit package keeps a single next per limiter
+var limitNext = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	r.Context().Value(limitNextKey{}).(http.Handler).ServeHTTP(w, r)
+})
+
+// limiter returns the per-IP limit of rate req/min for key (domain or
+// domain+route), the same key and rate share tokens between generations
+func limiter(key string, rate int) func(http.Handler) http.Handler {
+	id := fmt.Sprintf("%s %d", key, rate)
+	limitMu.Lock()
+	l, ok := limiters[id]
+	if !ok {
+		l = &limitEntry{h: ratelimit.Request(ratelimit.IP).Rate(rate, time.Minute).LimitBy(memory.NewLimited(1000))(limitNext)}
+		limiters[id] = l
+	}
+	l.gen = loadGen.Load()
+	limitMu.Unlock()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			l.h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), limitNextKey{}, next)))
+		})
+	}
+}
+
+// pruneLimiters drops the limiters not used by generation gen
+func pruneLimiters(gen uint64) {
+	limitMu.Lock()
+	defer limitMu.Unlock()
+	for id, l := range limiters {
+		if l.gen != gen {
+			delete(limiters, id)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLimiterReload(t *testing.T) {
+	before := len(limiters)
+	limiter("limit.example.com", 30)
+	limiter("limit.example.com", 30) // reload
+	limiter("limit.example.com/api/", 30)
+	limiter("limit.example.com", 60) // rate changed
+
+	if n := len(limiters) - before; n != 3 {
+		t.Errorf("expect limiters kept per key and rate, got=%d new", n)
+	}
+}
+
+func TestPruneLimiters(t *testing.T) {
+	limiter("gone.example.com", 30)
+	gen := loadGen.Add(1)
+	limiter("kept.example.com", 30)
+	pruneLimiters(gen)
+
+	if _, ok := limiters["gone.example.com 30"]; ok {
+		t.Errorf("expect unused limiter dropped")
+	}
+	if _, ok := limiters["kept.example.com 30"]; !ok {
+		t.Errorf("expect used limiter kept")
+	}
+}
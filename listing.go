@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mpdroog/hfast/handlers"
+	"github.com/mpdroog/hfast/logger"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// listEntry is a single file in a directory listing
+type listEntry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// Href is the (escaped) relative link to the entry
+func (e listEntry) Href() string {
+	if e.IsDir {
+		return url.PathEscape(e.Name) + "/"
+	}
+	return url.PathEscape(e.Name)
+}
+
+// Lookup valid sort columns
+var listSorts = map[string]func(a, b listEntry) bool{
+	"name":  func(a, b listEntry) bool { return a.Name < b.Name },
+	"size":  func(a, b listEntry) bool { return a.Size < b.Size },
+	"mtime": func(a, b listEntry) bool { return a.ModTime.Before(b.ModTime) },
+}
+
+// Plain HTML (sorting by links), CSP forbids inline script/style
+var listTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr>
+<th><a href="?sort=name&amp;order={{.Order "name"}}">Name</a></th>
+<th><a href="?sort=size&amp;order={{.Order "size"}}">Size</a></th>
+<th><a href="?sort=mtime&amp;order={{.Order "mtime"}}">Modified</a></th>
+</tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td><td>{{if not .IsDir}}{{.Size}}{{end}}</td><td>{{.ModTime.UTC.Format "2006-01-02 15:04"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type listPage struct {
+	Path    string
+	Sort    string
+	Desc    bool
+	Entries []listEntry
+}
+
+// Order returns the order a column link toggles to
+func (p listPage) Order(column string) string {
+	if p.Sort == column && !p.Desc {
+		return "desc"
+	}
+	return "asc"
+}
+
+// validateListing checks the Listing prefixes
+func validateListing(prefixes []string) []error {
+	errs := []error{}
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") {
+			errs = append(errs, fmt.Errorf("overrides.Listing invalid (expect /dir/), given=%s", prefix))
+		}
+	}
+	return errs
+}
+
+// listingEnabled reports if upath is below one of prefixes
+func listingEnabled(prefixes []string, upath string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(upath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readDir lists dir name in all layers of fsys, the first layer
+// wins on duplicate names
+func readDir(fsys FileSystem, name string) ([]os.FileInfo, error) {
+	layers := []FileSystem{fsys}
+	if o, ok := fsys.(*overlayFS); ok {
+		layers = o.layers
+	}
+
+	seen := make(map[string]bool)
+	out := []os.FileInfo{}
+	found := false
+	for _, l := range layers {
+		f, e := l.Open(name)
+		if e != nil {
+			continue
+		}
+		d, e := f.Stat()
+		if e != nil || !d.IsDir() {
+			f.Close()
+			continue
+		}
+		found = true
+		infos, e := f.Readdir(-1)
+		f.Close()
+		if e != nil {
+			return nil, e
+		}
+		for _, info := range infos {
+			if !seen[info.Name()] {
+				seen[info.Name()] = true
+				out = append(out, info)
+			}
+		}
+	}
+	if !found {
+		return nil, fs.ErrNotExist
+	}
+	return out, nil
+}
+
+// dirList renders dir name as HTML or, when preferred by Accept, JSON.
+// Dotfiles and .php are never listed.
+func dirList(w http.ResponseWriter, r *http.Request, fsys FileSystem, name string) {
+	infos, e := readDir(fsys, name)
+	if e != nil {
+		_, code := toHTTPError(e)
+		handlers.Error(w, r, code)
+		return
+	}
+
+	page := listPage{Path: r.URL.Path, Sort: r.URL.Query().Get("sort"), Desc: r.URL.Query().Get("order") == "desc", Entries: []listEntry{}}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") || strings.HasSuffix(info.Name(), ".php") {
+			continue
+		}
+		page.Entries = append(page.Entries, listEntry{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()})
+	}
+
+	less, ok := listSorts[page.Sort]
+	if !ok {
+		page.Sort = "name"
+		less = listSorts["name"]
+	}
+	sort.SliceStable(page.Entries, func(i, j int) bool {
+		a, b := page.Entries[i], page.Entries[j]
+		if a.IsDir != b.IsDir {
+			// Dirs first
+			return a.IsDir
+		}
+		if page.Desc {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Cache-Control", "no-cache")
+	if handlers.WantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if e := enc.Encode(page.Entries); e != nil {
+			logger.Printf("dirList(%s) e=%s", r.URL.Path, e.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if e := listTemplate.Execute(w, page); e != nil {
+		logger.Printf("dirList(%s) e=%s", r.URL.Path, e.Error())
+	}
+}
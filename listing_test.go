@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/mpdroog/hfast/config"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListing(t *testing.T) {
+	pub, theme := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		"downloads/a.zip":   "pub",
+		"downloads/b.txt":   "bb",
+		"downloads/.hidden": "no",
+		"downloads/x.php":   "no",
+		"downloads/sub/d":   "d",
+		"private/e.txt":     "e",
+	}
+	for name, content := range files {
+		fname := filepath.Join(pub, name)
+		if e := os.MkdirAll(filepath.Dir(fname), 0755); e != nil {
+			t.Fatal(e)
+		}
+		if e := os.WriteFile(fname, []byte(content), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := os.MkdirAll(filepath.Join(theme, "downloads"), 0755); e != nil {
+		t.Fatal(e)
+	}
+	if e := os.WriteFile(filepath.Join(theme, "downloads", "c.iso"), []byte("cccc"), 0644); e != nil {
+		t.Fatal(e)
+	}
+
+	old := config.Sites()
+	sites := config.NewVhosts()
+	sites.Overrides["example.com"] = config.Override{Listing: []string{"/downloads/"}}
+	config.SetSites(sites)
+	defer config.SetSites(old)
+
+	h := FileServer(Overlay(Dir(pub), Dir(theme)))
+
+	w := archiveGet(t, h, "/downloads/", nil)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("expect HTML listing, got=%d %v", w.Code, w.Header())
+	}
+	for _, name := range []string{`href="a.zip"`, `href="c.iso"`, `href="sub/"`} {
+		if !strings.Contains(body, name) {
+			t.Errorf("listing missing %s", name)
+		}
+	}
+	if strings.Contains(body, ".hidden") || strings.Contains(body, "x.php") {
+		t.Errorf("listing shows hidden files")
+	}
+
+	w = archiveGet(t, h, "/downloads/?sort=size&order=desc", map[string]string{"Accept": "application/json"})
+	var entries []listEntry
+	if e := json.Unmarshal(w.Body.Bytes(), &entries); e != nil {
+		t.Fatal(e)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if strings.Join(names, ",") != "sub,c.iso,a.zip,b.txt" {
+		t.Errorf("unexpected JSON order %v", names)
+	}
+
+	// Negotiated like error pages
+	if w := archiveGet(t, h, "/downloads/", map[string]string{"Accept": "application/vnd.api+json"}); w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("+json expect JSON listing, got=%s", w.Header().Get("Content-Type"))
+	}
+
+	if w := archiveGet(t, h, "/private/", nil); w.Code != http.StatusForbidden {
+		t.Errorf("listing outside prefix expect 403, got=%d", w.Code)
+	}
+}
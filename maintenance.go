@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/mpdroog/hfast/config"
+	"github.com/mpdroog/hfast/handlers"
+	"github.com/mpdroog/hfast/logger"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Admin API to switch maintenance on (POST ?retry=seconds) or off (DELETE)
+const maintenancePath = "/_maintenance"
+
+// Site file that puts the site in maintenance, optionally holding
+// the Retry-After seconds
+const maintenanceFile = "MAINTENANCE"
+
+// How often the MAINTENANCE file is checked
+const maintenanceCheck = time.Second
+
+// Retry-After when the MAINTENANCE file doesn't specify it
+const maintenanceRetry = 300
+
+// maintenance serves a 503 while the site's MAINTENANCE file exists,
+// Authlist IPs and Admin users pass
+type maintenance struct {
+	h        http.Handler
+	blocked  http.Handler
+	api      http.Handler
+	fname    string
+	admin    map[string]string
+	authlist map[string]bool
+
+	checked atomic.Int64 // unixnano
+	retry   atomic.Int64 // seconds, 0 is off
+}
+
+// Maintenance wraps the site handler h, the MAINTENANCE file lives in dir
+func Maintenance(h http.Handler, dir string, override config.Override) http.Handler {
+	m := &maintenance{
+		h:        h,
+		fname:    filepath.Join(dir, maintenanceFile),
+		admin:    override.Admin,
+		authlist: override.Authlist,
+	}
+	m.blocked = handlers.AccessLog(http.HandlerFunc(m.unavailable))
+	m.api = handlers.AccessLog(handlers.BasicAuth(http.HandlerFunc(m.toggle), "Backend", m.admin, m.authlist))
+	m.refresh()
+	return m
+}
+
+// refresh reads the MAINTENANCE file
+func (m *maintenance) refresh() {
+	m.checked.Store(time.Now().UnixNano())
+	buf, e := os.ReadFile(m.fname)
+	if e != nil {
+		if !os.IsNotExist(e) {
+			logger.Printf("maintenance(%s) e=%s", m.fname, e.Error())
+		}
+		m.retry.Store(0)
+		return
+	}
+	retry, e := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if e != nil || retry <= 0 {
+		retry = maintenanceRetry
+	}
+	m.retry.Store(int64(retry))
+}
+
+// active returns the Retry-After seconds, 0 when not in maintenance
+func (m *maintenance) active() int64 {
+	if time.Now().UnixNano()-m.checked.Load() > int64(maintenanceCheck) {
+		m.refresh()
+	}
+	return m.retry.Load()
+}
+
+func (m *maintenance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == maintenancePath {
+		if len(m.admin) == 0 && len(m.authlist) == 0 {
+			handlers.Error(w, r, http.StatusNotFound)
+			return
+		}
+		m.api.ServeHTTP(w, r)
+		return
+	}
+
+	if m.active() == 0 || strings.HasPrefix(r.URL.Path, "/queue/") || handlers.Allowed(r, m.admin, m.authlist) {
+		m.h.ServeHTTP(w, r)
+		return
+	}
+	m.blocked.ServeHTTP(w, r)
+}
+
+func (m *maintenance) unavailable(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.FormatInt(m.retry.Load(), 10))
+	handlers.Error(w, r, http.StatusServiceUnavailable)
+}
+
+// toggle maintenance by writing/removing the MAINTENANCE file,
+// so the state survives restarts
+func (m *maintenance) toggle(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		retry := r.URL.Query().Get("retry")
+		if retry != "" {
+			if n, e := strconv.Atoi(retry); e != nil || n <= 0 {
+				handlers.Error(w, r, http.StatusBadRequest)
+				return
+			}
+		}
+		if e := os.WriteFile(m.fname, []byte(retry), 0644); e != nil {
+			logger.Printf("maintenance(%s) e=%s", m.fname, e.Error())
+			handlers.Error(w, r, http.StatusInternalServerError)
+			return
+		}
+	case "DELETE":
+		if e := os.Remove(m.fname); e != nil && !os.IsNotExist(e) {
+			logger.Printf("maintenance(%s) e=%s", m.fname, e.Error())
+			handlers.Error(w, r, http.StatusInternalServerError)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		handlers.Error(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+	m.refresh()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	retry := m.retry.Load()
+	if e := json.NewEncoder(w).Encode(map[string]interface{}{"maintenance": retry > 0, "retry": retry}); e != nil {
+		logger.Printf("maintenance(%s) e=%s", m.fname, e.Error())
+	}
+}
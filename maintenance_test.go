@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/mpdroog/hfast/config"
+	"github.com/mpdroog/hfast/handlers"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+	handlers.SetLog(io.Discard)
+	dir := t.TempDir()
+	site := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("site"))
+	})
+	override := config.Override{
+		Admin:    map[string]string{"admin": "pass"},
+		Authlist: map[string]bool{"10.0.0.1": true},
+	}
+	h := Maintenance(site, dir, override)
+
+	get := func(url, remote string, auth bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		r.RemoteAddr = remote + ":1234"
+		if auth {
+			r.SetBasicAuth("admin", "pass")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get("/", "192.0.2.1", false); w.Body.String() != "site" {
+		t.Fatalf("expect site, got=%d %s", w.Code, w.Body.String())
+	}
+
+	if e := os.WriteFile(filepath.Join(dir, maintenanceFile), []byte("120\n"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	h.(*maintenance).checked.Store(0)
+
+	w := get("/", "192.0.2.1", false)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "120" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("expect 503 Retry-After=120, got=%d %v", w.Code, w.Header())
+	}
+	if w := get("/", "10.0.0.1", false); w.Body.String() != "site" {
+		t.Errorf("Authlist IP expect site, got=%d", w.Code)
+	}
+	if w := get("/", "192.0.2.1", true); w.Body.String() != "site" {
+		t.Errorf("Admin user expect site, got=%d", w.Code)
+	}
+	if w := get("/queue/", "192.0.2.1", false); w.Body.String() != "site" {
+		t.Errorf("queue expect site, got=%d", w.Code)
+	}
+
+	// Admin API
+	r := httptest.NewRequest(http.MethodDelete, maintenancePath, nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("API without auth expect 401, got=%d", w.Code)
+	}
+	r.SetBasicAuth("admin", "pass")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != `{"maintenance":false,"retry":0}`+"\n" {
+		t.Errorf("API DELETE unexpected %d %s", w.Code, w.Body.String())
+	}
+	if w := get("/", "192.0.2.1", false); w.Body.String() != "site" {
+		t.Errorf("expect site after DELETE, got=%d", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, maintenancePath+"?retry=60", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w := get("/", "192.0.2.1", false); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("expect 503 after POST, got=%d %v", w.Code, w.Header())
+	}
+	if _, e := os.Stat(filepath.Join(dir, maintenanceFile)); e != nil {
+		t.Errorf("POST expect %s, e=%s", maintenanceFile, e.Error())
+	}
+}
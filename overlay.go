@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+)
+
+// overlayFS searches layers in order, the site's pub/ first and
+// then the Fallback dirs from override.toml
+type overlayFS struct {
+	layers []FileSystem
+}
+
+// Overlay returns layers as a single FileSystem
+func Overlay(layers ...FileSystem) FileSystem {
+	if len(layers) == 1 {
+		return layers[0]
+	}
+	return &overlayFS{layers: layers}
+}
+
+func (o *overlayFS) String() string {
+	ids := make([]string, 0, len(o.layers))
+	for _, l := range o.layers {
+		ids = append(ids, fsID(l))
+	}
+	return strings.Join(ids, "|")
+}
+
+// Open returns name from the first layer that has it, other errors
+// than not found (i.e. permission denied) are not masked
+func (o *overlayFS) Open(name string) (File, error) {
+	var last error
+	for _, l := range o.layers {
+		f, e := l.Open(name)
+		if e == nil {
+			return f, nil
+		}
+		if !errors.Is(e, fs.ErrNotExist) {
+			return nil, e
+		}
+		last = e
+	}
+	return nil, last
+}
+
+func (o *overlayFS) Exists(name string) (bool, error) {
+	var last error
+	for _, l := range o.layers {
+		ok, e := l.Exists(name)
+		if ok {
+			return true, e
+		}
+		last = e
+	}
+	return false, last
+}
+
+// Layer returns the layer holding file name (or its revisioned
+// original), dirs are searched in all layers so stay on o
+func (o *overlayFS) Layer(name string) FileSystem {
+	names := []string{name}
+	if rev := revisioned(name); rev != name {
+		names = []string{rev, name}
+	}
+	for _, n := range names {
+		for _, l := range o.layers {
+			f, e := l.Open(n)
+			if e != nil {
+				continue
+			}
+			d, e := f.Stat()
+			f.Close()
+			if e != nil || d.IsDir() {
+				return o
+			}
+			return l
+		}
+	}
+	return o
+}
+
+// fileLayer narrows fs to the layer holding name, so theme/app.css
+// is never served with pub/app.css.br
+func fileLayer(fs FileSystem, name string) FileSystem {
+	if o, ok := fs.(*overlayFS); ok {
+		return o.Layer(name)
+	}
+	return fs
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	pub, theme := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		filepath.Join(pub, "app.css"):       "site",
+		filepath.Join(theme, "app.css"):     "theme",
+		filepath.Join(theme, "app.css.br"):  "theme-br",
+		filepath.Join(theme, "theme.js"):    "theme-js",
+		filepath.Join(theme, "theme.js.gz"): "theme-gz",
+		filepath.Join(theme, ".secret"):     "hidden",
+	}
+	for fname, content := range files {
+		if e := os.WriteFile(fname, []byte(content), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+	h := FileServer(Overlay(Dir(pub), Dir(theme)))
+
+	tests := []struct {
+		url, accept, body, encoding string
+	}{
+		// pub/ wins, the theme's .br belongs to the theme's app.css
+		{"/app.css", "br", "site", ""},
+		{"/theme.js", "", "theme-js", ""},
+		{"/theme.js", "gzip", "theme-gz", "gzip"},
+		{"/theme.v12.js", "gzip", "theme-gz", "gzip"},
+	}
+	for _, test := range tests {
+		w := archiveGet(t, h, test.url, map[string]string{"Accept-Encoding": test.accept})
+		if w.Body.String() != test.body || w.Header().Get("Content-Encoding") != test.encoding {
+			t.Errorf("%s (%s) expect=%s %s got=%s %s", test.url, test.accept, test.body, test.encoding, w.Body.String(), w.Header().Get("Content-Encoding"))
+		}
+	}
+
+	if w := archiveGet(t, h, "/.secret", nil); w.Code != http.StatusForbidden {
+		t.Errorf("dotfile in fallback expect 403, got=%d", w.Code)
+	}
+	if w := archiveGet(t, h, "/missing.css", nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing expect 404, got=%d", w.Code)
+	}
+}
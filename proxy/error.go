@@ -1,23 +1,18 @@
 package proxy
 
 import (
-	"github.com/mpdroog/hfast/logger"
+	"github.com/mpdroog/hfast/handlers"
 	"net/http"
 )
 
-func PrettyError(w http.ResponseWriter) {
-	w.Header().Set("Content-Type", "text/html")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(500)
-
-	if _, e := w.Write([]byte("500 - Failed forwarding.")); e != nil {
-		logger.Printf("Failed writing err=", e.Error())
-	}
+// PrettyError is the site's 502 page, the upstream failed
+func PrettyError(w http.ResponseWriter, r *http.Request) {
+	handlers.Error(w, r, http.StatusBadGateway)
 }
 
 type ErrorHandler struct {
 }
 
 func (e *ErrorHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
-	PrettyError(w)
+	PrettyError(w, req)
 }
@@ -71,7 +71,7 @@ func Proxy(to string) (http.HandlerFunc, error) {
 		ip, _, e := net.SplitHostPort(req.RemoteAddr)
 		if e != nil {
 			logger.Printf("net.SplitHostPort(%s) %s\n", req.RemoteAddr, e.Error())
-			PrettyError(w)
+			PrettyError(w, req)
 			return
 		}
 
@@ -80,7 +80,7 @@ func Proxy(to string) (http.HandlerFunc, error) {
 		proxReq, e := http.NewRequest(req.Method, dest, req.Body)
 		if e != nil {
 			logger.Printf("newRequest(%s) %s\n", dest, e.Error())
-			PrettyError(w)
+			PrettyError(w, req)
 			return
 		}
 
@@ -105,7 +105,7 @@ func Proxy(to string) (http.HandlerFunc, error) {
 			if !clientErr {
 				logger.Printf("netClient.Get(%s) %s\n", dest, e.Error())
 			}
-			PrettyError(w)
+			PrettyError(w, req)
 			return
 		}
 		defer res.Body.Close()
@@ -11,7 +11,7 @@
  *   <name> = {pending: X, first: <when it started processing>, last: <last time job was processed> lastOK: <last time job was sucessfully processed>, ok=N err=N}
  *
  * This package uses boltdb to save the entries in buckets.
- * /var/hfast.db > queue-bucket > name-bucket
+ * /var/hfast.db (QueueDB in hfast.toml) > queue-bucket > name-bucket
  */
 package queue
 
@@ -27,22 +27,31 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 var (
-	db       *bolt.DB
-	dbPath   string = "/var/hfast.db"
-	isLoaded bool
+	db     *bolt.DB
+	dbPath string
+
+	// Init runs on (re)load while Handle serves requests
+	loadMu   sync.Mutex
+	isLoaded atomic.Bool
 )
 
 type Job struct {
 	Id uint64
 }
 
-func Init() error {
-	if isLoaded {
+// Init opens the boltdb at path (once) and loads pending entries
+func Init(path string) error {
+	loadMu.Lock()
+	defer loadMu.Unlock()
+	if isLoaded.Load() {
 		return nil
 	}
+	dbPath = path
 
 	var err error
 	db, err = bolt.Open(dbPath, 0600, nil)
@@ -77,7 +86,7 @@ func Init() error {
 		return nil
 	})
 	if e == nil {
-		isLoaded = true
+		isLoaded.Store(true)
 	}
 	if config.Verbose {
 		fmt.Println("queue.Init finished")
@@ -100,7 +109,7 @@ const MaxQueueBodySize = 10 * 1024 * 1024
 // URL=/v1/url.json
 func Handle() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !isLoaded {
+		if !isLoaded.Load() {
 			panic("DevErr: Init never called")
 		}
 
@@ -128,12 +137,9 @@ func Handle() http.Handler {
 			}
 		}
 
-		/*
-			r.Header().Set("X-Domain", domain)
-			r.Header().Set("X-Secretkey", secretkey)
-		*/
-		domain := r.Header.Get("X-Domain")
-		secret := r.Header.Get("X-Secretkey")
+		site, _ := config.SiteOf(r)
+		domain := site.Domain
+		secret := site.Override.SecretKey
 
 		if secret == "" {
 			panic("Missing secret-key")
@@ -38,7 +38,7 @@ var requeue map[string]chan Msg // re=retry
 // Limit amount of connected workers
 const WORKER_MAX = 100
 
-// Default listener
+// Default listener (QueueListen in hfast.toml)
 const WORKER_LISTEN = "localhost:11300"
 
 func init() {
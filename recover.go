@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"github.com/mpdroog/hfast/handlers"
 	"github.com/mpdroog/hfast/logger"
 	"net/http"
 )
@@ -10,9 +11,9 @@ func RecoverWrap(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var err error
 		defer func() {
-			r := recover()
-			if r != nil {
-				switch t := r.(type) {
+			rec := recover()
+			if rec != nil {
+				switch t := rec.(type) {
 				case string:
 					err = errors.New(t)
 				case error:
@@ -21,7 +22,7 @@ func RecoverWrap(h http.Handler) http.Handler {
 					err = errors.New("Unknown error")
 				}
 				logger.Printf(err.Error())
-				http.Error(w, "Error, reported!", http.StatusInternalServerError)
+				handlers.Error(w, r, http.StatusInternalServerError)
 			}
 		}()
 		h.ServeHTTP(w, r)
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/mpdroog/hfast/config"
+	"github.com/mpdroog/hfast/handlers"
+	"github.com/mpdroog/hfast/logger"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// URL prefix of the resize endpoint
+const resizePrefix = "/_resize"
+
+// Resize limits, sources are checked before decoding so a huge
+// image can't exhaust memory
+const (
+	resizeMaxSide   = 4096
+	resizeMaxPixels = 40 * 1000 * 1000
+	resizeQuality   = 85
+)
+
+// Lookup valid fit modes
+var resizeFits = map[string]bool{
+	"contain": true, // fit within w x h, keep aspect ratio
+	"cover":   true, // fill w x h, crop the center
+	"fill":    true, // stretch to w x h
+}
+
+// Limit concurrent resizes to the amount of CPUs
+var resizeSem = make(chan struct{}, runtime.NumCPU())
+
+// resizeParams are the (signed) URL parameters, zero width or
+// height is derived from the aspect ratio
+type resizeParams struct {
+	Width   int
+	Height  int
+	Fit     string
+	Quality int
+}
+
+// canonical is the signed message, all parameters in fixed order
+func (p resizeParams) canonical(upath string) string {
+	return fmt.Sprintf("%s?w=%d&h=%d&fit=%s&q=%d", upath, p.Width, p.Height, p.Fit, p.Quality)
+}
+
+// signResize returns the hex HMAC-SHA256 for upath (below pub/) with p
+func signResize(key, upath string, p resizeParams) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(p.canonical(upath)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseResize reads w, h, fit and q from the query, applying defaults
+func parseResize(r *http.Request) (resizeParams, error) {
+	q := r.URL.Query()
+	p := resizeParams{Fit: "contain", Quality: resizeQuality}
+
+	var e error
+	if v := q.Get("w"); v != "" {
+		if p.Width, e = strconv.Atoi(v); e != nil || p.Width < 0 || p.Width > resizeMaxSide {
+			return p, fmt.Errorf("w invalid, given=%s", v)
+		}
+	}
+	if v := q.Get("h"); v != "" {
+		if p.Height, e = strconv.Atoi(v); e != nil || p.Height < 0 || p.Height > resizeMaxSide {
+			return p, fmt.Errorf("h invalid, given=%s", v)
+		}
+	}
+	if p.Width == 0 && p.Height == 0 {
+		return p, fmt.Errorf("w or h required")
+	}
+	if v := q.Get("fit"); v != "" {
+		if !resizeFits[v] {
+			return p, fmt.Errorf("fit invalid, given=%s", v)
+		}
+		p.Fit = v
+	}
+	if v := q.Get("q"); v != "" {
+		if p.Quality, e = strconv.Atoi(v); e != nil || p.Quality < 1 || p.Quality > 100 {
+			return p, fmt.Errorf("q invalid, given=%s", v)
+		}
+	}
+	return p, nil
+}
+
+// imageResizer serves /_resize/<path below pub>?w=&h=&fit=&q=&s=
+// with resized images cached on disk
+type imageResizer struct {
+	root      FileSystem
+	cache     string
+	key       string
+	protected []string // AuthRequest/Signed prefixes, never resized
+}
+
+// ImageResizer serves resized images from root, cached below cache
+func ImageResizer(root FileSystem, cache, key string, protected []string) http.Handler {
+	return &imageResizer{root: root, cache: cache, key: key, protected: protected}
+}
+
+func (z *imageResizer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		handlers.Error(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+	upath := strings.TrimPrefix(r.URL.Path, resizePrefix)
+	if upath != path.Clean(upath) || !strings.HasPrefix(upath, "/") || strings.Contains(upath, "/.") {
+		handlers.Error(w, r, http.StatusForbidden)
+		return
+	}
+	if !imageExts[strings.ToLower(path.Ext(upath))] {
+		handlers.Error(w, r, http.StatusForbidden)
+		return
+	}
+	for _, prefix := range z.protected {
+		if strings.HasPrefix(upath, prefix) {
+			// Resized copies are public, the original isn't
+			handlers.Error(w, r, http.StatusForbidden)
+			return
+		}
+	}
+
+	p, e := parseResize(r)
+	if e != nil {
+		handlers.Error(w, r, http.StatusBadRequest)
+		return
+	}
+	sig := r.URL.Query().Get("s")
+	if !hmac.Equal([]byte(sig), []byte(signResize(z.key, upath, p))) {
+		handlers.Error(w, r, http.StatusForbidden)
+		return
+	}
+
+	src, e := z.root.Open(upath)
+	if e != nil {
+		_, code := toHTTPError(e)
+		handlers.Error(w, r, code)
+		return
+	}
+	defer src.Close()
+	d, e := src.Stat()
+	if e != nil || d.IsDir() {
+		handlers.Error(w, r, http.StatusNotFound)
+		return
+	}
+
+	// Cache name changes with the source (size/mtime), so stale
+	// versions are never served
+	ext := ".jpg"
+	if strings.ToLower(path.Ext(upath)) != ".jpg" && strings.ToLower(path.Ext(upath)) != ".jpeg" {
+		ext = ".png"
+	}
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", p.canonical(upath), d.Size(), d.ModTime().UnixNano())))
+	name := "/" + hex.EncodeToString(h[:16]) + ext
+
+	cache := Dir(z.cache)
+	// Stat errors other than not exist are reported by resize
+	if ok, se := cache.Exists(name); !ok || se != nil {
+		resizeSem <- struct{}{}
+		// Another request could have made it while waiting
+		if ok, se := cache.Exists(name); !ok || se != nil {
+			e = z.resize(src, filepath.Join(z.cache, name), p, ext)
+		}
+		<-resizeSem
+		if e != nil {
+			logger.Printf("resize(%s) e=%s", upath, e.Error())
+			handlers.Error(w, r, resizeStatus(e))
+			return
+		}
+	}
+
+	f, e := cache.Open(name)
+	if e != nil {
+		_, code := toHTTPError(e)
+		handlers.Error(w, r, code)
+		return
+	}
+	defer f.Close()
+	fd, e := f.Stat()
+	if e != nil {
+		_, code := toHTTPError(e)
+		handlers.Error(w, r, code)
+		return
+	}
+	etag, e := fileETag(cache, name, fd, f)
+	if e != nil {
+		_, code := toHTTPError(e)
+		handlers.Error(w, r, code)
+		return
+	}
+	w.Header().Set("Etag", etag)
+	sizeFunc := func() (int64, error) { return fd.Size(), nil }
+	serveContent(w, r, fd.Name(), fd.ModTime(), sizeFunc, f)
+}
+
+// resizeSourceError is a source image that can't be resized
+type resizeSourceError struct {
+	error
+}
+
+func (e resizeSourceError) Unwrap() error {
+	return e.error
+}
+
+// resizeStatus returns 415/422 for a bad source, 500 for I/O errors
+func resizeStatus(e error) int {
+	if !errors.As(e, new(resizeSourceError)) {
+		return http.StatusInternalServerError
+	}
+	if errors.Is(e, image.ErrFormat) {
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// resize decodes src and writes the resized image to dst (atomically)
+func (z *imageResizer) resize(src File, dst string, p resizeParams, ext string) error {
+	cfg, _, e := image.DecodeConfig(src)
+	if e != nil {
+		return resizeSourceError{e}
+	}
+	if cfg.Width == 0 || cfg.Height == 0 {
+		return resizeSourceError{fmt.Errorf("source empty %dx%d", cfg.Width, cfg.Height)}
+	}
+	if cfg.Width*cfg.Height > resizeMaxPixels {
+		return resizeSourceError{fmt.Errorf("source too large %dx%d", cfg.Width, cfg.Height)}
+	}
+	if _, e := src.Seek(0, io.SeekStart); e != nil {
+		return e
+	}
+	img, _, e := image.Decode(src)
+	if e != nil {
+		return resizeSourceError{e}
+	}
+
+	out := resizeImage(img, p)
+
+	if e := os.MkdirAll(filepath.Dir(dst), 0755); e != nil {
+		return e
+	}
+	tmp, e := os.CreateTemp(filepath.Dir(dst), ".resize-*")
+	if e != nil {
+		return e
+	}
+	defer os.Remove(tmp.Name())
+
+	if ext == ".jpg" {
+		e = jpeg.Encode(tmp, out, &jpeg.Options{Quality: p.Quality})
+	} else {
+		e = png.Encode(tmp, out)
+	}
+	if e != nil {
+		tmp.Close()
+		return e
+	}
+	if e := tmp.Close(); e != nil {
+		return e
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// resizeImage scales img to p, images are never enlarged
+func resizeImage(img image.Image, p resizeParams) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	w, h := p.Width, p.Height
+	if w == 0 {
+		w = max(1, sw*h/sh)
+	}
+	if h == 0 {
+		h = max(1, sh*w/sw)
+	}
+
+	crop := b
+	switch p.Fit {
+	case "contain":
+		// Largest size within w x h with the source aspect ratio
+		if sw*h > sh*w {
+			h = max(1, sh*w/sw)
+		} else {
+			w = max(1, sw*h/sh)
+		}
+	case "cover":
+		// Center crop of the source with the target aspect ratio
+		if sw*h > sh*w {
+			cw := max(1, sh*w/h)
+			crop = image.Rect(b.Min.X+(sw-cw)/2, b.Min.Y, b.Min.X+(sw-cw)/2+cw, b.Max.Y)
+		} else {
+			ch := max(1, sw*h/w)
+			crop = image.Rect(b.Min.X, b.Min.Y+(sh-ch)/2, b.Max.X, b.Min.Y+(sh-ch)/2+ch)
+		}
+	}
+	if w > crop.Dx() || h > crop.Dy() {
+		// Don't enlarge, keep the target aspect ratio
+		scale := min(float64(crop.Dx())/float64(w), float64(crop.Dy())/float64(h))
+		w, h = max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale))
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(src, src.Bounds(), img, crop.Min, draw.Src)
+	return boxResize(src, w, h)
+}
+
+// boxResize downscales src to w x h by averaging the source pixels
+// covered by every target pixel (premultiplied, so no dark edges)
+func boxResize(src *image.RGBA, w, h int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					px := row[sx*4 : sx*4+4]
+					r += uint64(px[0])
+					g += uint64(px[1])
+					b += uint64(px[2])
+					a += uint64(px[3])
+					n++
+				}
+			}
+			i := y*dst.Stride + x*4
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// resizeCacheDir returns the on-disk cache of a site, it grows with
+// every signed parameter set and source version (see README to purge)
+func resizeCacheDir(domain string) string {
+	return filepath.Join(config.Server.ResizeCache, domain)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResize(t *testing.T) {
+	pub := t.TempDir()
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	for x := 0; x < 100; x++ {
+		for y := 0; y < 50; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), 0, 255, 255})
+		}
+	}
+	f, e := os.Create(filepath.Join(pub, "photo.png"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := png.Encode(f, img); e != nil {
+		t.Fatal(e)
+	}
+	f.Close()
+
+	const key = "secret"
+	z := ImageResizer(Dir(pub), t.TempDir(), key, []string{"/members/"})
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		z.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+
+	tests := []struct {
+		p    resizeParams
+		w, h int
+	}{
+		{resizeParams{Width: 40, Fit: "contain"}, 40, 20},
+		{resizeParams{Width: 40, Height: 40, Fit: "contain"}, 40, 20},
+		{resizeParams{Width: 40, Height: 40, Fit: "cover"}, 40, 40},
+		{resizeParams{Width: 40, Height: 40, Fit: "fill"}, 40, 40},
+		{resizeParams{Width: 400, Fit: "contain"}, 100, 50},
+	}
+	for _, test := range tests {
+		p := test.p
+		p.Quality = resizeQuality
+		url := fmt.Sprintf("/_resize/photo.png?w=%d&h=%d&fit=%s&s=%s", p.Width, p.Height, p.Fit, signResize(key, "/photo.png", p))
+
+		// second request is served from the disk cache
+		for i := 0; i < 2; i++ {
+			w := get(url)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%+v expect 200, got=%d %s", p, w.Code, w.Body.String())
+			}
+			if w.Header().Get("Content-Type") != "image/png" || w.Header().Get("Etag") == "" {
+				t.Errorf("%+v unexpected headers %v", p, w.Header())
+			}
+			out, e := png.Decode(w.Body)
+			if e != nil {
+				t.Fatal(e)
+			}
+			if b := out.Bounds(); b.Dx() != test.w || b.Dy() != test.h {
+				t.Errorf("%+v expect=%dx%d got=%dx%d", p, test.w, test.h, b.Dx(), b.Dy())
+			}
+		}
+	}
+
+	p := resizeParams{Width: 40, Fit: "contain", Quality: resizeQuality}
+	if w := get("/_resize/members/photo.png?w=40&s=" + signResize(key, "/members/photo.png", p)); w.Code != http.StatusForbidden {
+		t.Errorf("protected prefix expect 403, got=%d", w.Code)
+	}
+	if e := os.WriteFile(filepath.Join(pub, "fake.png"), []byte("not an image"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	if w := get("/_resize/fake.png?w=40&s=" + signResize(key, "/fake.png", p)); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("non-image expect 415, got=%d", w.Code)
+	}
+	if w := get("/_resize/photo.png?w=40&s=bad"); w.Code != http.StatusForbidden {
+		t.Errorf("bad signature expect 403, got=%d", w.Code)
+	}
+	if w := get("/_resize/photo.png?w=99999&s=bad"); w.Code != http.StatusBadRequest {
+		t.Errorf("huge width expect 400, got=%d", w.Code)
+	}
+	if w := get("/_resize/../photo.png?w=40&s=bad"); w.Code != http.StatusForbidden {
+		t.Errorf("traversal expect 403, got=%d", w.Code)
+	}
+}
+
+func TestResizeStatus(t *testing.T) {
+	// Cache dir can't be created, server side
+	cache := filepath.Join(t.TempDir(), "file")
+	if e := os.WriteFile(cache, nil, 0644); e != nil {
+		t.Fatal(e)
+	}
+	pub := t.TempDir()
+	f, e := os.Create(filepath.Join(pub, "photo.png"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := png.Encode(f, image.NewRGBA(image.Rect(0, 0, 10, 10))); e != nil {
+		t.Fatal(e)
+	}
+	f.Close()
+
+	z := ImageResizer(Dir(pub), filepath.Join(cache, "site"), "secret", nil)
+	p := resizeParams{Width: 5, Fit: "contain", Quality: resizeQuality}
+	w := httptest.NewRecorder()
+	z.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_resize/photo.png?w=5&s="+signResize("secret", "/photo.png", p), nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("cache failure expect 500, got=%d", w.Code)
+	}
+
+	if code := resizeStatus(resizeSourceError{fmt.Errorf("source empty 0x10")}); code != http.StatusUnprocessableEntity {
+		t.Errorf("bad source expect 422, got=%d", code)
+	}
+}
+
+func TestResizeCoverExtremeAspect(t *testing.T) {
+	tests := []struct {
+		src image.Rectangle
+		p   resizeParams
+	}{
+		{image.Rect(0, 0, 1000, 1), resizeParams{Width: 1, Height: 2, Fit: "cover"}},
+		{image.Rect(0, 0, 1, 1000), resizeParams{Width: 2, Height: 1, Fit: "cover"}},
+	}
+	for _, test := range tests {
+		out := resizeImage(image.NewRGBA(test.src), test.p)
+		if b := out.Bounds(); b.Dx() < 1 || b.Dy() < 1 {
+			t.Errorf("%v %+v unexpected size %v", test.src, test.p, b)
+		}
+	}
+}
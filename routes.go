@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"github.com/NYTimes/gziphandler"
+	"github.com/mpdroog/hfast/config"
+	"github.com/mpdroog/hfast/handlers"
+	"github.com/mpdroog/hfast/proxy"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Prefixes mounted by hfast itself, a route can't take them over
+var reservedRoutes = map[string]bool{
+	"/":                true,
+	"/action/":         true,
+	"/admin/":          true,
+	"/index.php":       true,
+	maintenancePath:    true,
+	"/queue/":          true,
+	resizePrefix + "/": true,
+}
+
+// validateRoutes checks the prefixes and that every route has exactly
+// one of PHP, Dir or Proxy
+func validateRoutes(override config.Override) []error {
+	errs := []error{}
+	for _, prefix := range routePrefixes(override.Routes) {
+		route := override.Routes[prefix]
+		if !strings.HasPrefix(prefix, "/") || path.Clean(prefix) != strings.TrimSuffix(prefix, "/") && prefix != "/" {
+			errs = append(errs, fmt.Errorf("overrides.Routes invalid prefix, given=%s", prefix))
+			continue
+		}
+		if strings.ContainsAny(prefix, "{} \t") || strings.Contains(prefix, "/.") {
+			errs = append(errs, fmt.Errorf("overrides.Routes invalid prefix, given=%s", prefix))
+			continue
+		}
+		if reservedRoutes[prefix] || strings.HasPrefix(prefix, "/debug/") {
+			errs = append(errs, fmt.Errorf("overrides.Routes reserved prefix, given=%s", prefix))
+			continue
+		}
+
+		n := 0
+		if len(route.PHP) > 0 {
+			n++
+			if !validScript(route.PHP) {
+				errs = append(errs, fmt.Errorf("overrides.Routes[%s].PHP invalid (expect script below site dir), given=%s", prefix, route.PHP))
+			}
+		}
+		if len(route.Dir) > 0 {
+			n++
+			if !filepath.IsAbs(route.Dir) {
+				errs = append(errs, fmt.Errorf("overrides.Routes[%s].Dir not absolute, given=%s", prefix, route.Dir))
+			}
+			for _, protected := range override.Protected() {
+				// Signed and AuthRequest only guard pub/
+				if strings.HasPrefix(prefix, protected) || strings.HasPrefix(protected, prefix) {
+					errs = append(errs, fmt.Errorf("overrides.Routes[%s].Dir overlaps protected prefix %s", prefix, protected))
+				}
+			}
+		}
+		if len(route.Proxy) > 0 {
+			n++
+			if e := validateUpstream(route.Proxy); e != nil {
+				errs = append(errs, fmt.Errorf("overrides.Routes[%s].%s", prefix, e.Error()))
+			}
+		}
+		if n != 1 {
+			errs = append(errs, fmt.Errorf("overrides.Routes[%s] needs exactly one of PHP, Dir or Proxy", prefix))
+		}
+		if route.Auth && len(override.Admin) == 0 && len(override.Authlist) == 0 {
+			errs = append(errs, fmt.Errorf("overrides.Routes[%s] cannot enable Auth when admin-mode not enabled", prefix))
+		}
+		if route.RatelimitRate < 0 {
+			errs = append(errs, fmt.Errorf("overrides.Routes[%s].RatelimitRate invalid, given=%d", prefix, route.RatelimitRate))
+		}
+	}
+	return errs
+}
+
+// validScript reports if script is a .php below the site dir
+func validScript(script string) bool {
+	return filepath.IsLocal(script) && strings.HasSuffix(script, ".php")
+}
+
+// routePrefixes returns the prefixes sorted, for stable errors
+func routePrefixes(routes map[string]config.Route) []string {
+	prefixes := make([]string, 0, len(routes))
+	for prefix := range routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// routeHandler builds the handler of a (validated) route
+func routeHandler(domain, prefix string, route config.Route, override config.Override, fpm *fpmUpstream) (http.Handler, error) {
+	var h http.Handler
+	switch {
+	case len(route.PHP) > 0:
+		h = NewHandler(filepath.Join(config.Webdir, domain, route.PHP), fpm)
+	case len(route.Dir) > 0:
+		h = http.StripPrefix(strings.TrimSuffix(prefix, "/"), FileServer(HotFS(Dir(route.Dir))))
+	default:
+		fn, e := proxy.Proxy(route.Proxy)
+		if e != nil {
+			return nil, e
+		}
+		h = fn
+	}
+
+	if route.Ratelimit {
+		rate := route.RatelimitRate
+		if rate == 0 {
+			rate = override.Rate()
+		}
+		h = handlers.LimitPage(limiter(domain+prefix, rate)(h))
+	}
+	if route.Gzip {
+		h = gziphandler.GzipHandler(h)
+	}
+	if len(route.PHP) > 0 {
+		h = Sendfile(h, override.PrivateDir(domain))
+	}
+	h = handlers.AccessLog(h)
+	if route.Auth || override.DevMode {
+		h = handlers.BasicAuth(h, "Backend", override.Admin, override.Authlist)
+	}
+	return h, nil
+}
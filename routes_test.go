@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/mpdroog/hfast/config"
+	"github.com/mpdroog/hfast/handlers"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateRoutes(t *testing.T) {
+	override := config.Override{
+		Admin: map[string]string{"admin": "pass"},
+		Routes: map[string]config.Route{
+			"/api/":      {PHP: "api/index.php", Ratelimit: true, RatelimitRate: 60},
+			"/webhooks/": {Proxy: "http://127.0.0.1:4000", Auth: true},
+			"/docs/":     {Dir: "/srv/docs", Gzip: true},
+		},
+	}
+	if errs := validateRoutes(override); len(errs) > 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+
+	bad := map[string]config.Route{
+		"api/":       {PHP: "api/index.php"},
+		"/a//b/":     {PHP: "api/index.php"},
+		"/{x}/":      {PHP: "api/index.php"},
+		"/action/":   {PHP: "api/index.php"},
+		"/debug/x/":  {PHP: "api/index.php"},
+		"/escape/":   {PHP: "../other/index.php"},
+		"/notphp/":   {PHP: "api/index.html"},
+		"/rel/":      {Dir: "srv/docs"},
+		"/badproxy/": {Proxy: "127.0.0.1:4000"},
+		"/none/":     {},
+		"/both/":     {PHP: "api/index.php", Dir: "/srv/docs"},
+		"/auth/":     {Dir: "/srv/docs", Auth: true},
+	}
+	for prefix, route := range bad {
+		errs := validateRoutes(config.Override{Routes: map[string]config.Route{prefix: route}})
+		if len(errs) == 0 {
+			t.Errorf("expect error for %s %+v", prefix, route)
+		}
+	}
+
+	// Dir mounts would bypass Signed/AuthRequest
+	protected := config.Override{
+		Signed:      []string{"/invoices/"},
+		AuthRequest: map[string]string{"/members/": "auth/index.php"},
+		Routes: map[string]config.Route{
+			"/invoices/2024/": {Dir: "/srv/invoices"},
+			"/members/files/": {Dir: "/srv/files"},
+			"/members/api/":   {PHP: "api/index.php"},
+		},
+	}
+	if errs := validateRoutes(protected); len(errs) != 2 {
+		t.Errorf("expect overlapping Dir routes refused, got=%v", errs)
+	}
+}
+
+func TestRouteHandler(t *testing.T) {
+	handlers.SetLog(io.Discard)
+	dir := t.TempDir()
+	if e := os.WriteFile(filepath.Join(dir, "guide.txt"), []byte("guide"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	h, e := routeHandler("example.com", "/docs/", config.Route{Dir: dir}, config.Override{}, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if w := archiveGet(t, h, "/docs/guide.txt", nil); w.Code != http.StatusOK || w.Body.String() != "guide" {
+		t.Errorf("dir route expect guide, got=%d %s", w.Code, w.Body.String())
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	defer upstream.Close()
+	h, e = routeHandler("example.com", "/webhooks/", config.Route{Proxy: upstream.URL}, config.Override{}, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if w := archiveGet(t, h, "/webhooks/stripe", nil); w.Body.String() != "upstream /webhooks/stripe" {
+		t.Errorf("proxy route expect full path, got=%s", w.Body.String())
+	}
+
+	override := config.Override{Admin: map[string]string{"admin": "pass"}}
+	h, e = routeHandler("example.com", "/docs/", config.Route{Dir: dir, Auth: true}, override, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if w := archiveGet(t, h, "/docs/guide.txt", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("auth route expect 401, got=%d", w.Code)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/mpdroog/hfast/handlers"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Response headers PHP uses to hand a file to hfast
+var sendfileHeaders = []string{"X-Sendfile", "X-Accel-Redirect"}
+
+// PHP headers not copied to a sendfile response, they describe the
+// PHP output (or are set for the file)
+var sendfileSkip = map[string]bool{
+	"X-Sendfile":       true,
+	"X-Accel-Redirect": true,
+	"Content-Type":     true,
+	"Content-Length":   true,
+	"Content-Encoding": true,
+	"Content-Range":    true,
+	"Accept-Ranges":    true,
+	"Etag":             true,
+	"Last-Modified":    true,
+	"Vary":             true,
+}
+
+// Sendfile serves the file named by PHP's X-Sendfile/X-Accel-Redirect
+// response header from dir, the PHP body is discarded. The file gets
+// Range and conditional requests, caching is up to PHP
+func Sendfile(h http.Handler, dir string) http.Handler {
+	fs := Dir(dir)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &sendfileWriter{ResponseWriter: w, header: make(http.Header)}
+		h.ServeHTTP(sw, r)
+		if !sw.wroteHeader {
+			sw.WriteHeader(http.StatusOK)
+		}
+		if sw.name == "" {
+			return
+		}
+
+		name, ok := sendfileName(dir, sw.name)
+		if !ok {
+			handlers.Error(w, r, http.StatusForbidden)
+			return
+		}
+		for k, vv := range sw.header {
+			if !sendfileSkip[k] {
+				w.Header()[k] = vv
+			}
+		}
+		sendfile(w, r, fs, name)
+	})
+}
+
+// sendfile serves name from fs, unlike serveFile without the URL
+// checks (PHP picked the name) and CacheRules (those are for pub/)
+func sendfile(w http.ResponseWriter, r *http.Request, fs FileSystem, name string) {
+	f, e := fs.Open(name)
+	if e != nil {
+		_, code := toHTTPError(e)
+		handlers.Error(w, r, code)
+		return
+	}
+	defer f.Close()
+	d, e := f.Stat()
+	if e != nil {
+		_, code := toHTTPError(e)
+		handlers.Error(w, r, code)
+		return
+	}
+	if d.IsDir() {
+		handlers.Error(w, r, http.StatusForbidden)
+		return
+	}
+	etag, e := fileETag(fs, name, d, f)
+	if e != nil {
+		_, code := toHTTPError(e)
+		handlers.Error(w, r, code)
+		return
+	}
+
+	w.Header().Set("Etag", etag)
+	if w.Header().Get("Cache-Control") == "" {
+		// PHP authorized it, not for shared caches
+		w.Header().Set("Cache-Control", "private")
+	}
+	sizeFunc := func() (int64, error) { return d.Size(), nil }
+	serveContent(w, r, d.Name(), d.ModTime(), sizeFunc, f)
+}
+
+// sendfileName maps the header value onto a name below dir, X-Sendfile
+// may hold the absolute path, X-Accel-Redirect the path below dir
+func sendfileName(dir, value string) (string, bool) {
+	if rel, e := filepath.Rel(filepath.Clean(dir), value); e == nil && filepath.IsAbs(value) && filepath.IsLocal(rel) {
+		value = rel
+	}
+	value = filepath.ToSlash(value)
+	for _, part := range strings.Split(value, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+	return path.Clean("/" + value), true
+}
+
+// sendfileWriter holds back the PHP response until the headers show
+// if it's a sendfile
+type sendfileWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	name        string
+	wroteHeader bool
+}
+
+func (s *sendfileWriter) Header() http.Header {
+	return s.header
+}
+
+func (s *sendfileWriter) WriteHeader(code int) {
+	if s.wroteHeader {
+		return
+	}
+	s.wroteHeader = true
+	for _, k := range sendfileHeaders {
+		if v := s.header.Get(k); v != "" && code >= 200 && code < 300 {
+			s.name = v
+			return
+		}
+	}
+	for k, vv := range s.header {
+		if k != "X-Sendfile" && k != "X-Accel-Redirect" {
+			s.ResponseWriter.Header()[k] = vv
+		}
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *sendfileWriter) Write(b []byte) (int, error) {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	if s.name != "" {
+		// PHP body is replaced by the file
+		return len(b), nil
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *sendfileWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok && s.wroteHeader && s.name == "" {
+		f.Flush()
+	}
+}
+
+func (s *sendfileWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/NYTimes/gziphandler"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSendfile(t *testing.T) {
+	dir := t.TempDir()
+	if e := os.MkdirAll(filepath.Join(dir, "invoices"), 0755); e != nil {
+		t.Fatal(e)
+	}
+	if e := os.WriteFile(filepath.Join(dir, "invoices", "1.txt"), []byte("invoice one"), 0644); e != nil {
+		t.Fatal(e)
+	}
+
+	for _, name := range []string{"scan.png", ".2024/a.txt", "export.php"} {
+		if e := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); e != nil {
+			t.Fatal(e)
+		}
+		if e := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	php := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.URL.Query().Get("accel"); v != "" {
+			w.Header().Set("X-Accel-Redirect", v)
+		}
+		if v := r.URL.Query().Get("cc"); v != "" {
+			w.Header().Set("Cache-Control", v)
+		}
+		if v := r.URL.Query().Get("sendfile"); v != "" {
+			w.Header().Set("X-Sendfile", v)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="1.txt"`)
+		w.Write([]byte("php body"))
+	})
+	h := Sendfile(gziphandler.GzipHandler(php), dir)
+
+	w := archiveGet(t, h, "/action/?accel=/invoices/1.txt", map[string]string{"Accept-Encoding": "gzip"})
+	if w.Code != http.StatusOK || w.Body.String() != "invoice one" {
+		t.Fatalf("expect file, got=%d %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "text/plain; charset=utf-8" || w.Header().Get("Content-Disposition") == "" {
+		t.Errorf("unexpected headers %v", w.Header())
+	}
+	if w.Header().Get("X-Accel-Redirect") != "" || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("PHP headers leaked %v", w.Header())
+	}
+
+	w = archiveGet(t, h, "/action/?sendfile="+filepath.Join(dir, "invoices", "1.txt"), map[string]string{"Range": "bytes=8-10"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "one" {
+		t.Errorf("X-Sendfile range expect 206 one, got=%d %s", w.Code, w.Body.String())
+	}
+	etag := w.Header().Get("Etag")
+	if w := archiveGet(t, h, "/action/?accel=/invoices/1.txt", map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified {
+		t.Errorf("expect 304, got=%d", w.Code)
+	}
+
+	if w := archiveGet(t, h, "/action/?accel=/invoices/../../etc/passwd", nil); w.Code != http.StatusForbidden {
+		t.Errorf("traversal expect 403, got=%d", w.Code)
+	}
+	if w := archiveGet(t, h, "/action/?accel=/invoices/2.txt", nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing expect 404, got=%d", w.Code)
+	}
+	// PHP decides on caching, CacheRules don't apply
+	if w := archiveGet(t, h, "/action/?accel=/scan.png&cc=no-store", nil); w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("expect PHP Cache-Control, got=%s", w.Header().Get("Cache-Control"))
+	}
+	if w := archiveGet(t, h, "/action/?accel=/scan.png", nil); w.Header().Get("Cache-Control") != "private" {
+		t.Errorf("expect private, got=%s", w.Header().Get("Cache-Control"))
+	}
+	// Names in the private dir aren't URLs
+	for _, name := range []string{"/.2024/a.txt", "/export.php"} {
+		if w := archiveGet(t, h, "/action/?accel="+name, nil); w.Code != http.StatusOK || w.Body.String() != name[1:] {
+			t.Errorf("%s expect file, got=%d %s", name, w.Code, w.Body.String())
+		}
+	}
+	if w := archiveGet(t, h, "/action/", nil); w.Body.String() != "php body" {
+		t.Errorf("expect PHP body, got=%s", w.Body.String())
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/NYTimes/gziphandler"
+	"github.com/coreos/go-systemd/daemon"
+	"github.com/mpdroog/hfast/config"
+	"github.com/mpdroog/hfast/handlers"
+	"github.com/mpdroog/hfast/logger"
+	"github.com/mpdroog/hfast/proxy"
+	"github.com/mpdroog/hfast/queue"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/text/language"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Lookup valid site types
+var siteTypes = map[string]bool{
+	"":         true,
+	"weak":     true,
+	"indexphp": true,
+	"spa":      true,
+}
+
+// validateOverride returns all semantic errors in a site's override.toml,
+// shared by loadSites and the -t config test
+func validateOverride(override config.Override) []error {
+	errs := []error{}
+	if !siteTypes[override.SiteType] {
+		errs = append(errs, fmt.Errorf("overrides.SiteType invalid, given=%s", override.SiteType))
+	}
+	if override.Pprof && len(override.Admin) == 0 && len(override.Authlist) == 0 {
+		errs = append(errs, fmt.Errorf("cannot enable pprof when admin-mode not enabled"))
+	}
+	if len(override.Proxy) > 0 {
+		if e := validateUpstream(override.Proxy); e != nil {
+			errs = append(errs, fmt.Errorf("overrides.%s", e.Error()))
+		}
+	}
+	for _, lang := range override.Lang {
+		if _, e := language.Parse(lang); e != nil {
+			errs = append(errs, fmt.Errorf("overrides.Lang invalid, given=%s e=%s", lang, e.Error()))
+		}
+	}
+	for _, addr := range override.PHPFPM {
+		if _, _, e := parseBackend(addr); e != nil {
+			errs = append(errs, fmt.Errorf("overrides.%s", e.Error()))
+		}
+	}
+	errs = append(errs, validateCacheRules(override.CacheRules)...)
+	errs = append(errs, validatePrecompress(override.Precompress)...)
+	errs = append(errs, validateListing(override.Listing)...)
+	errs = append(errs, validateTryFiles(override.TryFiles)...)
+	errs = append(errs, validateRoutes(override)...)
+	errs = append(errs, validateAuthRequest(override.AuthRequest)...)
+	errs = append(errs, validateEnv(override.Env)...)
+	for _, prefix := range override.Signed {
+		if !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") {
+			errs = append(errs, fmt.Errorf("overrides.Signed invalid (expect /dir/), given=%s", prefix))
+		}
+	}
+	if len(override.Signed) > 0 && len(override.SecretKey) == 0 {
+		errs = append(errs, fmt.Errorf("cannot enable Signed when SecretKey not set"))
+	}
+	for _, dir := range override.Fallback {
+		if !filepath.IsAbs(dir) {
+			errs = append(errs, fmt.Errorf("overrides.Fallback not absolute, given=%s", dir))
+		}
+	}
+	if len(override.Private) > 0 && !filepath.IsAbs(override.Private) {
+		errs = append(errs, fmt.Errorf("overrides.Private not absolute, given=%s", override.Private))
+	}
+	if !fpmBalances[override.PHPFPMBalance] {
+		errs = append(errs, fmt.Errorf("overrides.PHPFPMBalance invalid, given=%s", override.PHPFPMBalance))
+	}
+	return errs
+}
+
+// validateUpstream checks a proxy address
+func validateUpstream(to string) error {
+	u, e := url.Parse(to)
+	if e != nil {
+		return fmt.Errorf("Proxy invalid, given=%s e=%s", to, e.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Proxy invalid, given=%s (expect http(s)://host[:port])", to)
+	}
+	return nil
+}
+
+// Site archives used instead of pub/ (in this order)
+var pubArchives = []string{"pub.zip", "pub.tar"}
+
+// pubFS returns the static files of a site, pub.zip/pub.tar
+// when present else the pub/ dir, followed by the Fallback dirs
+func pubFS(domain string, override config.Override) (FileSystem, error) {
+	base := fmt.Sprintf(config.Webdir+"/%s", domain)
+	var pub FileSystem
+	for _, name := range pubArchives {
+		if ok, _ := exists(base + "/" + name); ok {
+			archive, e := ArchiveFS(base + "/" + name)
+			if e != nil {
+				return nil, e
+			}
+			pub = archive
+			break
+		}
+	}
+	if pub == nil {
+		pub = HotFS(Dir(base + "/pub"))
+	}
+
+	layers := []FileSystem{pub}
+	for _, dir := range override.Fallback {
+		layers = append(layers, HotFS(Dir(dir)))
+	}
+	return Overlay(layers...), nil
+}
+
+// Custom error pages above this size are ignored
+const errorPageMax = 1024 * 1024
+
+// errorPages returns the custom error pages of a site, read on use
+// so a deploy doesn't need a reload
+func errorPages(fs FileSystem) func(code int) []byte {
+	return func(code int) []byte {
+		f, e := fs.Open(fmt.Sprintf("/_errors/%d.html", code))
+		if e != nil {
+			return nil
+		}
+		defer f.Close()
+		d, e := f.Stat()
+		if e != nil || d.IsDir() || d.Size() > errorPageMax {
+			return nil
+		}
+		page, e := io.ReadAll(f)
+		if e != nil {
+			logger.Printf("errorPages(%d) e=%s", code, e.Error())
+			return nil
+		}
+		return page
+	}
+}
+
+// loadGen counts loadSites runs, the shared registries (fpmBackends,
+// limiters, archiveSites, hotRoots) mark what a generation uses
+var loadGen atomic.Uint64
+
+// loadSites scans config.Webdir and builds a new vhost generation,
+// it does not touch the active one so a failed reload keeps serving
+func loadSites() (*config.Vhosts, error) {
+	loadGen.Add(1)
+	domains, e := getDomains()
+	if e != nil {
+		return nil, e
+	}
+
+	sites := config.NewVhosts()
+	// Lookup tbl for translating www-domain to domain
+	// (using lookup to ensure the domain is valid)
+	wwwDomains := []string{}
+
+	for _, domain := range domains {
+		fname := fmt.Sprintf(config.Webdir+"/%s/override.toml", domain)
+		override, unknown, e := decodeOverride(fname)
+		if e != nil {
+			fmt.Printf("WARN_SKIP: Failed parsing(%s) e=%s\n", fname, e.Error())
+			continue
+		}
+		for _, key := range unknown {
+			fmt.Printf("WARN: %s unknown key %s (run hfast -t)\n", fname, key)
+		}
+		if errs := validateOverride(override); len(errs) > 0 {
+			return nil, fmt.Errorf("%s: %s", domain, errs[0].Error())
+		}
+
+		pub, e := pubFS(domain, override)
+		if e != nil {
+			return nil, fmt.Errorf("%s: %s", domain, e.Error())
+		}
+		sites.Errors[domain] = errorPages(pub)
+
+		if domain == "default" {
+			// Fallback domain
+			fs := FileServer(pub)
+			mux := &http.ServeMux{}
+			mux.Handle("/", fs)
+			sites.Muxs[domain] = handlers.SecureWrapper(Maintenance(handlers.AccessLog(mux), fmt.Sprintf(config.Webdir+"/%s", domain), override))
+			sites.Overrides[domain] = override
+			continue
+		}
+		if !strings.HasPrefix(domain, "www.") {
+			wwwDomains = append(wwwDomains, "www."+domain)
+		}
+
+		// Reverse Proxy-mode (passing data to next node)
+		if len(override.Proxy) > 0 {
+			fn, e := proxy.Proxy(override.Proxy)
+			if e != nil {
+				return nil, e
+			}
+			mux := &http.ServeMux{}
+			// Devmode-enforces auth (IP or user+pass) protected domain
+			if override.DevMode {
+				mux.Handle("/", handlers.AccessLog(handlers.BasicAuth(fn, "Backend", override.Admin, override.Authlist)))
+			} else {
+				mux.Handle("/", handlers.AccessLog(fn))
+			}
+			sites.Overrides[domain] = override
+			sites.Muxs[domain] = handlers.SecureWrapper(Maintenance(mux, fmt.Sprintf(config.Webdir+"/%s", domain), override))
+			continue
+		}
+
+		// Auto-redirect homepage request to /supported_lang/index
+		if len(override.Lang) > 0 {
+			var tags []language.Tag
+			for _, lang := range override.Lang {
+				// validateOverride already checked the tags
+				tags = append(tags, language.Make(lang))
+			}
+			sites.Langs[domain] = language.NewMatcher(tags)
+		}
+
+		// Serve pub-dir and add ratelimiter
+		var fs http.Handler = FileServer(pub)
+		limit := limiter(domain, override.Rate()) // default 30req/min
+
+		mux := &http.ServeMux{}
+		if len(override.SecretKey) > 0 {
+			if e := queue.Init(config.Server.QueueDB); e != nil {
+				return nil, e
+			}
+			sites.Queues = true
+			mux.Handle("/queue/", handlers.AccessLog(queue.Handle()))
+		}
+
+		// PHP-FPM backend(s) shared by /admin/ and /action/
+		fpm, e := newUpstream(override.FPM(), override.PHPFPMBalance)
+		if e != nil {
+			return nil, fmt.Errorf("%s: %s", domain, e.Error())
+		}
+
+		// Add /admin-path for mgmt
+		if len(override.Admin) > 0 {
+			admin := Sendfile(gziphandler.GzipHandler(NewHandler(fmt.Sprintf(config.Webdir+"/%s/admin/index.php", domain), fpm)), override.PrivateDir(domain))
+			mux.Handle("/admin/", handlers.BasicAuth(handlers.AccessLog(admin), "Backend", override.Admin, override.Authlist))
+		}
+
+		if override.Pprof {
+			// Activate pprof on admin backend with authentication
+			mux.Handle("/debug/pprof/", handlers.BasicAuth(http.HandlerFunc(pprof.Index), "Backend", override.Admin, override.Authlist))
+			mux.Handle("/debug/pprof/cmdline", handlers.BasicAuth(http.HandlerFunc(pprof.Cmdline), "Backend", override.Admin, override.Authlist))
+			mux.Handle("/debug/pprof/profile", handlers.BasicAuth(http.HandlerFunc(pprof.Profile), "Backend", override.Admin, override.Authlist))
+			mux.Handle("/debug/pprof/symbol", handlers.BasicAuth(http.HandlerFunc(pprof.Symbol), "Backend", override.Admin, override.Authlist))
+			mux.Handle("/debug/pprof/trace", handlers.BasicAuth(http.HandlerFunc(pprof.Trace), "Backend", override.Admin, override.Authlist))
+			mux.Handle("/debug/fpm", handlers.BasicAuth(FPMStats(), "Backend", override.Admin, override.Authlist))
+			mux.Handle("/debug/hotcache", handlers.BasicAuth(HotCacheStats(), "Backend", override.Admin, override.Authlist))
+		}
+
+		// Base-path to make PHP active
+		path := "/action/"
+		if override.SiteType == "indexphp" {
+			path = "/index.php"
+		}
+
+		php := NewHandler(fmt.Sprintf(config.Webdir+"/%s/action/index.php", domain), fpm)
+		action := gziphandler.GzipHandler(handlers.LimitPage(limit(php)))
+		if !override.Ratelimit {
+			action = gziphandler.GzipHandler(php)
+		}
+		action = Sendfile(action, override.PrivateDir(domain))
+
+		// Static with try_files, "@php" falls through to action
+		tryFiles := override.TryFiles
+		if len(tryFiles) == 0 && override.SiteType == "spa" {
+			tryFiles = spaTryFiles
+		}
+		if len(tryFiles) > 0 {
+			fs = TryFiles(pub, tryFiles, action, override.SiteType == "spa")
+		}
+
+		if len(override.Signed) > 0 {
+			fs = handlers.Signed(fs, override.Signed, override.SecretKey)
+		}
+
+		// Static prefixes authorized by PHP
+		if len(override.AuthRequest) > 0 {
+			scripts := make(map[string]http.Handler, len(override.AuthRequest))
+			for prefix, script := range override.AuthRequest {
+				var auth http.Handler = NewHandler(filepath.Join(config.Webdir, domain, script), fpm)
+				if override.Ratelimit {
+					// Every uncached path/cookie costs a PHP request
+					auth = limit(auth)
+				}
+				scripts[prefix] = auth
+			}
+			fs = AuthRequest(fs, scripts)
+		}
+
+		action = handlers.AccessLog(action)
+		base := handlers.AccessLog(handlers.LangRedirect(fs))
+		if override.DevMode {
+			action = handlers.BasicAuth(action, "Backend", override.Admin, override.Authlist)
+			base = handlers.BasicAuth(base, "Backend", override.Admin, override.Authlist)
+		}
+
+		if len(override.ImageKey) > 0 {
+			resizer := handlers.AccessLog(ImageResizer(pub, resizeCacheDir(domain), override.ImageKey, override.Protected()))
+			if override.DevMode {
+				resizer = handlers.BasicAuth(resizer, "Backend", override.Admin, override.Authlist)
+			}
+			mux.Handle(resizePrefix+"/", resizer)
+		}
+
+		for prefix, route := range override.Routes {
+			h, e := routeHandler(domain, prefix, route, override, fpm)
+			if e != nil {
+				return nil, fmt.Errorf("%s: %s", domain, e.Error())
+			}
+			mux.Handle(prefix, h)
+		}
+
+		mux.Handle(path, action)
+		mux.Handle("/", base)
+
+		sites.Overrides[domain] = override
+		sites.Muxs[domain] = handlers.SecureWrapper(Maintenance(mux, fmt.Sprintf(config.Webdir+"/%s", domain), override))
+	}
+	sites.Hosts = append(domains, wwwDomains...)
+	return sites, nil
+}
+
+// hostPolicy is the autocert whitelist, swapped on reload so newly
+// added site dirs get certificates
+type hostPolicy struct {
+	v atomic.Value
+}
+
+func (h *hostPolicy) Set(hosts []string) {
+	h.v.Store(autocert.HostWhitelist(hosts...))
+}
+
+func (h *hostPolicy) Allow(ctx context.Context, host string) error {
+	return h.v.Load().(autocert.HostPolicy)(ctx, host)
+}
+
+// queueServer starts the worker listener once, also when a reload
+// is the first to enable a queue
+type queueServer struct {
+	wg      *sync.WaitGroup
+	mu      sync.Mutex
+	started bool
+}
+
+func (q *queueServer) Start() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.started {
+		return nil
+	}
+
+	fn, e := queue.Serve(config.Server.QueueListen)
+	if e != nil {
+		return fmt.Errorf("queue.Serve e=%s", e.Error())
+	}
+	q.started = true
+	q.wg.Add(1)
+	go func() {
+		if e := fn(); e != nil {
+			fmt.Printf("queue.Serve e=%s\n", e.Error())
+		}
+		q.wg.Done()
+	}()
+	return nil
+}
+
+// Shutdown stops accepting workers
+func (q *queueServer) Shutdown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.started {
+		return
+	}
+	if e := queue.Listen.Close(); e != nil {
+		fmt.Printf("queue.Listen.Close e=%s\n", e.Error())
+	}
+}
+
+// Close the queue db
+func (q *queueServer) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.started {
+		return
+	}
+	if e := queue.Close(); e != nil {
+		fmt.Printf("queue.Close e=%s\n", e.Error())
+	}
+}
+
+// reload rescans config.Webdir and atomically swaps in the new vhosts,
+// in-flight requests finish on the handler they started with
+func reload(policy *hostPolicy, queues *queueServer) error {
+	if _, e := daemon.SdNotify(false, daemon.SdNotifyReloading); e != nil {
+		logger.Printf("SdNotify(RELOADING) e=%s", e.Error())
+	}
+	defer func() {
+		if _, e := daemon.SdNotify(false, daemon.SdNotifyReady); e != nil {
+			logger.Printf("SdNotify(READY) e=%s", e.Error())
+		}
+	}()
+
+	sites, e := loadSites()
+	if e != nil {
+		return e
+	}
+	if sites.Queues {
+		if e := queues.Start(); e != nil {
+			return e
+		}
+	}
+
+	policy.Set(sites.Hosts)
+	config.SetSites(sites)
+	pruneShared(loadGen.Load())
+	fmt.Printf("server.reload sites=%d\n", len(sites.Muxs))
+	return nil
+}
+
+// pruneShared drops what sites removed on reload left in the shared
+// registries, in-flight requests of the old generation still finish
+func pruneShared(gen uint64) {
+	pruneBackends(gen)
+	pruneLimiters(gen)
+	pruneArchives(gen)
+	pruneHotRoots(gen)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mpdroog/hfast/handlers"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Default TryFiles of SiteType "spa", unknown paths get the app
+var spaTryFiles = []string{"$uri", "$uri/", "/index.html"}
+
+// validateTryFiles checks the TryFiles candidates
+func validateTryFiles(files []string) []error {
+	errs := []error{}
+	for _, c := range files {
+		switch {
+		case c == "@php":
+		case strings.HasPrefix(c, "="):
+			if code, e := strconv.Atoi(c[1:]); e != nil || code < 400 || code > 599 {
+				errs = append(errs, fmt.Errorf("overrides.TryFiles invalid status, given=%s", c))
+			}
+		case strings.HasPrefix(c, "/") || strings.HasPrefix(c, "$uri"):
+			if strings.Contains(c, "/.") {
+				errs = append(errs, fmt.Errorf("overrides.TryFiles dotfile, given=%s", c))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("overrides.TryFiles invalid (expect $uri.., /path, @php or =404), given=%s", c))
+		}
+	}
+	return errs
+}
+
+// tryFiles serves the first existing candidate, nginx try_files alike:
+// "$uri" is replaced by the request path, a trailing / means a dir
+// with index.html, "@php" passes to PHP and "=404" ends with a status
+type tryFiles struct {
+	fs    FileSystem
+	files []string
+	php   http.Handler
+	spa   bool // asset-looking paths (with extension) only get $uri
+}
+
+// TryFiles returns the static handler for sites with TryFiles or SiteType "spa"
+func TryFiles(fs FileSystem, files []string, php http.Handler, spa bool) http.Handler {
+	return &tryFiles{fs: fs, files: files, php: php, spa: spa}
+}
+
+func (t *tryFiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+	asset := path.Ext(upath) != ""
+
+	for _, c := range t.files {
+		if c == "@php" {
+			if t.php == nil {
+				break
+			}
+			t.php.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(c, "=") {
+			code, _ := strconv.Atoi(c[1:])
+			handlers.Error(w, r, code)
+			return
+		}
+		if t.spa && asset && !strings.Contains(c, "$uri") {
+			// Missing app.js shouldn't get index.html
+			continue
+		}
+
+		candidate := strings.ReplaceAll(c, "$uri", upath)
+		dir := strings.HasSuffix(candidate, "/")
+		name := path.Clean(candidate)
+		if dir {
+			if ok, _ := t.fs.Exists(path.Join(name, "index.html")); !ok {
+				continue
+			}
+			t.serve(w, r, name, strings.TrimSuffix(name, "/")+"/")
+			return
+		}
+		if t.isFile(name) {
+			if path.Base(name) == "index.html" {
+				// serveFile redirects .../index.html to .../
+				name = path.Dir(name)
+				t.serve(w, r, name, strings.TrimSuffix(name, "/")+"/")
+				return
+			}
+			t.serve(w, r, name, name)
+			return
+		}
+	}
+	handlers.Error(w, r, http.StatusNotFound)
+}
+
+// isFile reports if name (or its revisioned original) is a file
+func (t *tryFiles) isFile(name string) bool {
+	for _, n := range []string{name, revisioned(name)} {
+		f, e := t.fs.Open(n)
+		if e != nil {
+			continue
+		}
+		d, e := f.Stat()
+		f.Close()
+		if e == nil && !d.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// serve name with the request rewritten to upath, so CacheRules
+// apply to the file that is sent
+func (t *tryFiles) serve(w http.ResponseWriter, r *http.Request, name, upath string) {
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path = upath
+	r2.URL = &u
+	serveFile(w, r2, t.fs, name, false)
+}
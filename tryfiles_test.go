@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/mpdroog/hfast/config"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTryFiles(t *testing.T) {
+	pub := t.TempDir()
+	files := map[string]string{
+		"index.html":      "app",
+		"about.html":      "about",
+		"js/app.js":       "js",
+		"docs/index.html": "docs",
+	}
+	for name, content := range files {
+		fname := filepath.Join(pub, name)
+		if e := os.MkdirAll(filepath.Dir(fname), 0755); e != nil {
+			t.Fatal(e)
+		}
+		if e := os.WriteFile(fname, []byte(content), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	old := config.Sites()
+	sites := config.NewVhosts()
+	sites.Overrides["example.com"] = config.Override{SiteType: "spa"}
+	config.SetSites(sites)
+	defer config.SetSites(old)
+
+	spa := TryFiles(Dir(pub), spaTryFiles, nil, true)
+	tests := []struct {
+		url  string
+		code int
+		body string
+	}{
+		{"/users/42", http.StatusOK, "app"},
+		{"/", http.StatusOK, "app"},
+		{"/js/app.js", http.StatusOK, "js"},
+		{"/js/app.v3.js", http.StatusOK, "js"},
+		{"/docs", http.StatusOK, "docs"},
+		{"/js/missing.js", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		w := archiveGet(t, spa, test.url, nil)
+		if w.Code != test.code || (test.body != "" && w.Body.String() != test.body) {
+			t.Errorf("spa %s expect %d %s, got=%d %s", test.url, test.code, test.body, w.Code, w.Body.String())
+		}
+	}
+
+	php := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("php " + r.URL.Path))
+	})
+	clean := TryFiles(Dir(pub), []string{"$uri", "$uri.html", "@php"}, php, false)
+	if w := archiveGet(t, clean, "/about", nil); w.Body.String() != "about" {
+		t.Errorf("clean URL expect about, got=%s", w.Body.String())
+	}
+	if w := archiveGet(t, clean, "/blog/post.json", nil); w.Body.String() != "php /blog/post.json" {
+		t.Errorf("expect @php with original path, got=%s", w.Body.String())
+	}
+
+	strict := TryFiles(Dir(pub), []string{"$uri", "=410"}, nil, false)
+	if w := archiveGet(t, strict, "/about", nil); w.Code != http.StatusGone {
+		t.Errorf("expect 410, got=%d", w.Code)
+	}
+}
+
+func TestValidateTryFiles(t *testing.T) {
+	if errs := validateTryFiles([]string{"$uri", "$uri/", "$uri.html", "/index.html", "@php", "=404"}); len(errs) > 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+	for _, c := range []string{"index.html", "@node", "=200", "=abc", "/.env"} {
+		if errs := validateTryFiles([]string{c}); len(errs) == 0 {
+			t.Errorf("expect error for %s", c)
+		}
+	}
+}
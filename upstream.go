@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mpdroog/hfast/config"
+	"github.com/mpdroog/hfast/logger"
+	"github.com/yookoala/gofast"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a PHP-FPM backend is skipped after a failed dial
+const fpmFailTimeout = 10 * time.Second
+
+// Lookup valid balance modes
+var fpmBalances = map[string]bool{
+	"":           true,
+	"roundrobin": true,
+	"leastconn":  true,
+}
+
+// fpmBackend is a single PHP-FPM pool, shared by all sites (and
+// reloads) using the same address so health, idle connections and
+// counters survive (see fcgipool.go for the connection pool)
+type fpmBackend struct {
+	network string
+	address string
+
+	inUse       atomic.Int64 // connections handling a request
+	failedUntil atomic.Int64 // unixnano, 0=healthy
+	gen         uint64       // last loadSites using it (fpmBackendsMu)
+
+	pool fpmPool
+}
+
+var (
+	fpmBackendsMu sync.Mutex
+	fpmBackends   = make(map[string]*fpmBackend)
+)
+
+// parseBackend splits an address from override.toml/hfast.toml
+// into network and address for net.Dial
+func parseBackend(addr string) (network, address string, e error) {
+	if strings.HasPrefix(addr, "/") {
+		return "unix", addr, nil
+	}
+	if toks := strings.SplitN(addr, ":", 2); len(toks) == 2 {
+		switch toks[0] {
+		case "unix":
+			if len(toks[1]) == 0 {
+				return "", "", fmt.Errorf("PHPFPM(%s) missing socket path", addr)
+			}
+			return "unix", toks[1], nil
+		case "tcp", "tcp4", "tcp6":
+			network, addr = toks[0], toks[1]
+		}
+	}
+	if network == "" {
+		network = "tcp"
+	}
+	if _, _, e := net.SplitHostPort(addr); e != nil {
+		return "", "", fmt.Errorf("PHPFPM(%s) invalid e=%s", addr, e.Error())
+	}
+	return network, addr, nil
+}
+
+func getBackend(addr string) (*fpmBackend, error) {
+	network, address, e := parseBackend(addr)
+	if e != nil {
+		return nil, e
+	}
+
+	fpmBackendsMu.Lock()
+	defer fpmBackendsMu.Unlock()
+	key := network + "://" + address
+	b, ok := fpmBackends[key]
+	if !ok {
+		b = &fpmBackend{network: network, address: address}
+		b.pool.init(config.Server.FPMMaxIdle, config.Server.FPMMaxOpen, config.Server.FPMIdleTimeout)
+		go b.reap()
+		fpmBackends[key] = b
+	}
+	b.gen = loadGen.Load()
+	return b, nil
+}
+
+// pruneBackends closes the backends not used by generation gen
+func pruneBackends(gen uint64) {
+	fpmBackendsMu.Lock()
+	defer fpmBackendsMu.Unlock()
+	for key, b := range fpmBackends {
+		if b.gen != gen {
+			delete(fpmBackends, key)
+			b.close()
+			logger.Printf("fpm(%s) unused, closed", key)
+		}
+	}
+}
+
+func (b *fpmBackend) String() string {
+	return b.network + "://" + b.address
+}
+
+func (b *fpmBackend) healthy(now time.Time) bool {
+	return b.failedUntil.Load() < now.UnixNano()
+}
+
+func (b *fpmBackend) dial() (net.Conn, error) {
+	conn, e := net.DialTimeout(b.network, b.address, 5*time.Second)
+	if e != nil {
+		if b.failedUntil.Swap(time.Now().Add(fpmFailTimeout).UnixNano()) == 0 {
+			logger.Printf("fpm(%s) marked failed e=%s", b.String(), e.Error())
+		}
+		return nil, e
+	}
+	if b.failedUntil.Swap(0) != 0 {
+		logger.Printf("fpm(%s) recovered", b.String())
+	}
+	return conn, nil
+}
+
+// fpmUpstream balances a site over one or more backends
+type fpmUpstream struct {
+	backends  []*fpmBackend
+	leastConn bool
+	next      atomic.Uint64
+}
+
+func newUpstream(addrs []string, balance string) (*fpmUpstream, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("PHPFPM empty")
+	}
+	if !fpmBalances[balance] {
+		return nil, fmt.Errorf("PHPFPMBalance invalid, given=%s", balance)
+	}
+
+	u := &fpmUpstream{leastConn: balance == "leastconn"}
+	for _, addr := range addrs {
+		b, e := getBackend(addr)
+		if e != nil {
+			return nil, e
+		}
+		u.backends = append(u.backends, b)
+	}
+	return u, nil
+}
+
+// order returns the backends in the order to try them, healthy
+// ones first (as balanced) and failed ones last as fallback
+func (u *fpmUpstream) order() []*fpmBackend {
+	n := len(u.backends)
+	out := make([]*fpmBackend, 0, n)
+	if u.leastConn {
+		out = append(out, u.backends...)
+		// insertion sort, lists are tiny
+		for i := 1; i < n; i++ {
+			for j := i; j > 0 && out[j].inUse.Load() < out[j-1].inUse.Load(); j-- {
+				out[j], out[j-1] = out[j-1], out[j]
+			}
+		}
+	} else {
+		start := int(u.next.Add(1) % uint64(n))
+		for i := 0; i < n; i++ {
+			out = append(out, u.backends[(start+i)%n])
+		}
+	}
+
+	now := time.Now()
+	healthy := make([]*fpmBackend, 0, n)
+	failed := []*fpmBackend{}
+	for _, b := range out {
+		if b.healthy(now) {
+			healthy = append(healthy, b)
+		} else {
+			failed = append(failed, b)
+		}
+	}
+	return append(healthy, failed...)
+}
+
+// Client implements gofast.ClientFactory, it hands out a pooled
+// keep-conn connection from the first backend that has one available
+func (u *fpmUpstream) Client() (gofast.Client, error) {
+	var last error
+	for _, b := range u.order() {
+		conn, e := b.acquire()
+		if e == nil {
+			return &pooledClient{conn: conn}, nil
+		}
+		last = e
+	}
+	return nil, last
+}
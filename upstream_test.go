@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseBackend(t *testing.T) {
+	m := map[string][2]string{
+		"127.0.0.1:8000":           {"tcp", "127.0.0.1:8000"},
+		"tcp:127.0.0.1:8000":       {"tcp", "127.0.0.1:8000"},
+		"tcp6:[::1]:9000":          {"tcp6", "[::1]:9000"},
+		"[::1]:9000":               {"tcp", "[::1]:9000"},
+		"unix:/run/php/fpm.sock":   {"unix", "/run/php/fpm.sock"},
+		"/run/php/php8.3-fpm.sock": {"unix", "/run/php/php8.3-fpm.sock"},
+	}
+	for in, out := range m {
+		network, address, e := parseBackend(in)
+		if e != nil {
+			t.Errorf("parseBackend(%s) e=%s", in, e.Error())
+			continue
+		}
+		if network != out[0] || address != out[1] {
+			t.Errorf("parseBackend(%s) expect=%v got=%s %s", in, out, network, address)
+		}
+	}
+
+	for _, in := range []string{"unix:", "127.0.0.1", "tcp:nope"} {
+		if _, _, e := parseBackend(in); e == nil {
+			t.Errorf("parseBackend(%s) expected error", in)
+		}
+	}
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// Reserve a port and close it so dialing it fails
+	dead, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	u, e := newUpstream([]string{deadAddr, ln.Addr().String()}, "roundrobin")
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 4; i++ {
+		c, e := u.Client()
+		if e != nil {
+			t.Fatalf("Client(%d) e=%s", i, e.Error())
+		}
+		conn := c.(*pooledClient).conn
+		if conn.RemoteAddr().String() != ln.Addr().String() {
+			t.Errorf("Client(%d) expected healthy backend, got=%s", i, conn.RemoteAddr().String())
+		}
+		c.Close()
+	}
+	if u.backends[0].healthy(time.Now()) {
+		t.Errorf("dead backend not marked failed")
+	}
+	if n := u.backends[1].inUse.Load(); n != 0 {
+		t.Errorf("active connections not released, got=%d", n)
+	}
+}
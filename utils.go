@@ -1,12 +1,14 @@
 package main
 
 import (
+	"expvar"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/mpdroog/hfast/config"
 	"golang.org/x/net/netutil"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 )
@@ -40,8 +42,10 @@ func exists(path string) (bool, error) {
 	return true, err
 }
 
-func getOverride(path string) (config.Override, error) {
-	c := config.Override{}
+// getGlobal parses hfast.toml on top of the defaults, keys not
+// given keep their default value
+func getGlobal(path string) (config.Global, error) {
+	c := config.DefaultGlobal()
 
 	if _, e := os.Stat(path); os.IsNotExist(e) {
 		return c, nil
@@ -52,12 +56,55 @@ func getOverride(path string) (config.Override, error) {
 		return c, e
 	}
 	defer r.Close()
-	_, e = toml.DecodeReader(r, &c)
+	meta, e := toml.DecodeReader(r, &c)
+	if e != nil {
+		return c, e
+	}
+	if keys := meta.Undecoded(); len(keys) > 0 {
+		return c, fmt.Errorf("%s: unknown key %s", path, keys[0].String())
+	}
+	if errs := validatePrecompress(c.Precompress); len(errs) > 0 {
+		return c, fmt.Errorf("%s: %s", path, errs[0].Error())
+	}
+	if c.Trusted, e = parseTrusted(c.TrustedProxies); e != nil {
+		return c, fmt.Errorf("%s: %s", path, e.Error())
+	}
+	return c, nil
+}
+
+func getOverride(path string) (config.Override, error) {
+	c, _, e := decodeOverride(path)
 	return c, e
 }
 
+// decodeOverride parses override.toml and returns the keys
+// that did not map on config.Override (typos etc.)
+func decodeOverride(path string) (config.Override, []string, error) {
+	c := config.Override{}
+
+	if _, e := os.Stat(path); os.IsNotExist(e) {
+		return c, nil, nil
+	}
+
+	r, e := os.Open(path)
+	if e != nil {
+		return c, nil, e
+	}
+	defer r.Close()
+	meta, e := toml.DecodeReader(r, &c)
+	if e != nil {
+		return c, nil, e
+	}
+
+	unknown := []string{}
+	for _, key := range meta.Undecoded() {
+		unknown = append(unknown, key.String())
+	}
+	return c, unknown, nil
+}
+
 func limit(aln net.Listener) net.Listener {
-	return netutil.LimitListener(aln, config.MAX_WORKERS)
+	return netutil.LimitListener(aln, config.Server.MaxWorkers)
 }
 
 func listener(addr string) (net.Listener, error) {
@@ -66,5 +113,20 @@ func listener(addr string) (net.Listener, error) {
 		return nil, e
 	}
 	aln := TCPKeepAliveListener{ln.(*net.TCPListener)}
-	return netutil.LimitListener(aln, config.MAX_WORKERS), nil
+	return netutil.LimitListener(aln, config.Server.MaxWorkers), nil
+}
+
+// expvarHandler serves the published expvar name as JSON
+func expvarHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprintf(w, "%s\n", expvar.Get(name).String())
+	})
+}
+
+// siteOf returns the override of the site r is routed to
+func siteOf(r *http.Request) config.Override {
+	site, _ := config.SiteOf(r)
+	return site.Override
 }